@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	goflag "flag"
 
 	"k8s.io/cloud-provider/names"
@@ -9,6 +10,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/uthoplatforms/utho-cloud-controller-manager/utho"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/cloud-provider/app"
 	"k8s.io/cloud-provider/app/config"
@@ -17,6 +19,8 @@ import (
 	"k8s.io/component-base/logs"
 	_ "k8s.io/component-base/metrics/prometheus/clientgo" // load all the prometheus client-go plugins
 	_ "k8s.io/component-base/metrics/prometheus/version"  // for version metric registration
+	genericcontrollermanager "k8s.io/controller-manager/app"
+	"k8s.io/controller-manager/controller"
 	"k8s.io/klog/v2"
 )
 
@@ -30,12 +34,34 @@ func main() {
 
 	controllerAliases := names.CCMControllerAliases()
 
+	fss := flag.NamedFlagSets{}
+	utho.AddFlags(fss.FlagSet("utho"))
+
+	controllerInitializers := map[string]app.ControllerInitFuncConstructor{}
+	for name, constructor := range app.DefaultInitFuncConstructors {
+		controllerInitializers[name] = constructor
+	}
+	controllerInitializers[utho.GatewayControllerName] = app.ControllerInitFuncConstructor{
+		InitContext: app.ControllerInitContext{ClientName: "utho-gateway-controller"},
+		Constructor: startGatewayControllerWrapper,
+	}
+	controllerInitializers[utho.LBClassControllerName] = app.ControllerInitFuncConstructor{
+		InitContext: app.ControllerInitContext{ClientName: "utho-lb-class-controller"},
+		Constructor: startLBClassControllerWrapper,
+	}
+	controllerInitializers[utho.DriftControllerName] = app.ControllerInitFuncConstructor{
+		InitContext: app.ControllerInitContext{ClientName: "utho-lb-drift-controller"},
+		Constructor: startDriftControllerWrapper,
+	}
+	// the Gateway API controller is opt-in: --controllers=*,utho-gateway
+	app.ControllersDisabledByDefault.Insert(utho.GatewayControllerName)
+
 	command := app.NewCloudControllerManagerCommand(
 		ccmOptions,
 		cloudInitializer,
-		app.DefaultInitFuncConstructors,
+		controllerInitializers,
 		controllerAliases,
-		flag.NamedFlagSets{},
+		fss,
 		wait.NeverStop)
 
 	utho.Options.KubeconfigFlag = command.Flags().Lookup("kubeconfig")
@@ -45,9 +71,6 @@ func main() {
 
 	defer logs.FlushLogs()
 
-	// utho.SetupSecretWatcher(context.Background())
-	// go utho.SecretWatcher.WatchSecrets()
-
 	if err := command.Execute(); err != nil {
 		klog.Fatal(err)
 	}
@@ -64,5 +87,45 @@ func cloudInitializer(c *config.CompletedConfig) cloudprovider.Interface {
 		klog.Fatalf("Cloud provider is nil")
 	}
 
+	// the webhook runs on every replica, independently of leader election
+	if err := utho.StartWebhookServer(wait.NeverStop); err != nil {
+		klog.Fatalf("Webhook server could not be started: %v", err)
+	}
+
 	return cloud
 }
+
+func startLBClassControllerWrapper(initContext app.ControllerInitContext, completedConfig *config.CompletedConfig, cloud cloudprovider.Interface) app.InitFunc {
+	return func(ctx context.Context, controllerContext genericcontrollermanager.ControllerContext) (controller.Interface, bool, error) {
+		kubeClient := completedConfig.ClientBuilder.ClientOrDie(initContext.ClientName)
+		err := utho.StartLBClassController(ctx, cloud, completedConfig.ComponentConfig.KubeCloudShared.ClusterName,
+			kubeClient, controllerContext.InformerFactory.Core().V1().Services(), controllerContext.InformerFactory.Core().V1().Nodes())
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+}
+
+func startDriftControllerWrapper(_ app.ControllerInitContext, _ *config.CompletedConfig, cloud cloudprovider.Interface) app.InitFunc {
+	return func(ctx context.Context, controllerContext genericcontrollermanager.ControllerContext) (controller.Interface, bool, error) {
+		started, err := utho.StartDriftController(ctx, cloud, controllerContext.InformerFactory.Core().V1().Services())
+		return nil, started, err
+	}
+}
+
+func startGatewayControllerWrapper(initContext app.ControllerInitContext, completedConfig *config.CompletedConfig, cloud cloudprovider.Interface) app.InitFunc {
+	return func(ctx context.Context, _ genericcontrollermanager.ControllerContext) (controller.Interface, bool, error) {
+		restConfig := completedConfig.ClientBuilder.ConfigOrDie(initContext.ClientName)
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, false, err
+		}
+
+		kubeClient := completedConfig.ClientBuilder.ClientOrDie(initContext.ClientName)
+		if err := utho.StartGatewayController(ctx, cloud, kubeClient, dynamicClient); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+}
@@ -0,0 +1,92 @@
+package utho
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/uthoplatforms/utho-go/utho"
+)
+
+// sharedClient is the Utho client shared by instancesv2, loadbalancers and the
+// inventory. It forwards every call to the client of the current API key, which
+// the secret watcher replaces when the key is rotated. Services returned before
+// a swap keep using the previous client for the call in progress, while requests
+// built with NewRequest are sent with the key current when Do is called.
+type sharedClient struct {
+	mu     sync.RWMutex
+	client utho.Client
+	token  string
+}
+
+var _ utho.Client = &sharedClient{}
+
+// newUthoClient creates a client for the Utho API at Options.APIURL.
+func newUthoClient(token string) (utho.Client, error) {
+	var clientOptions []utho.UthoOption
+	if Options.APIURL != "" {
+		clientOptions = append(clientOptions, utho.WithBaseURL(Options.APIURL))
+	}
+	client, err := utho.NewClient(token, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("newUthoClient: %w", err)
+	}
+	return client, nil
+}
+
+func newSharedClient(token string) (*sharedClient, error) {
+	client, err := newUthoClient(token)
+	if err != nil {
+		return nil, fmt.Errorf("newSharedClient: %w", err)
+	}
+	return &sharedClient{client: client, token: token}, nil
+}
+
+// current returns the client of the current API key and the key.
+func (c *sharedClient) current() (utho.Client, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client, c.token
+}
+
+// swap makes every later call use client, created for token.
+func (c *sharedClient) swap(client utho.Client, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client, c.token = client, token
+}
+
+func (c *sharedClient) get() utho.Client {
+	client, _ := c.current()
+	return client
+}
+
+func (c *sharedClient) NewRequest(method, url string, body ...interface{}) (*http.Request, error) {
+	return c.get().NewRequest(method, url, body...)
+}
+
+func (c *sharedClient) Do(req *http.Request, v interface{}) (*http.Response, error) {
+	client, token := c.current()
+	// the request may have been built, and authenticated, before a swap
+	req.Header.Set("Authorization", "Bearer "+token)
+	return client.Do(req, v)
+}
+
+func (c *sharedClient) Account() *utho.AccountService               { return c.get().Account() }
+func (c *sharedClient) ApiKey() *utho.ApiKeyService                 { return c.get().ApiKey() }
+func (c *sharedClient) Action() *utho.ActionService                 { return c.get().Action() }
+func (c *sharedClient) CloudInstances() *utho.CloudInstancesService { return c.get().CloudInstances() }
+func (c *sharedClient) Domain() *utho.DomainService                 { return c.get().Domain() }
+func (c *sharedClient) Firewall() *utho.FirewallService             { return c.get().Firewall() }
+func (c *sharedClient) ISO() *utho.ISOService                       { return c.get().ISO() }
+func (c *sharedClient) Loadbalancers() *utho.LoadbalancersService   { return c.get().Loadbalancers() }
+func (c *sharedClient) Monitoring() *utho.MonitoringService         { return c.get().Monitoring() }
+func (c *sharedClient) ObjectStorage() *utho.ObjectStorageService   { return c.get().ObjectStorage() }
+func (c *sharedClient) Sqs() *utho.SqsService                       { return c.get().Sqs() }
+func (c *sharedClient) Ssl() *utho.SslService                       { return c.get().Ssl() }
+func (c *sharedClient) Stacks() *utho.StacksService                 { return c.get().Stacks() }
+func (c *sharedClient) TargetGroup() *utho.TargetGroupService       { return c.get().TargetGroup() }
+func (c *sharedClient) Vpc() *utho.VpcService                       { return c.get().Vpc() }
+func (c *sharedClient) AutoScaling() *utho.AutoScalingService       { return c.get().AutoScaling() }
+func (c *sharedClient) Kubernetes() *utho.KubernetesService         { return c.get().Kubernetes() }
+func (c *sharedClient) Ebs() *utho.EBService                        { return c.get().Ebs() }
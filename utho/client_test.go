@@ -0,0 +1,44 @@
+package utho
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSharedClientSwap(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	apiURL := Options.APIURL
+	Options.APIURL = server.URL + "/"
+	defer func() { Options.APIURL = apiURL }()
+
+	shared, err := newSharedClient("old-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := shared.NewRequest("GET", "account/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is rotated between building and sending the request
+	client, err := newUthoClient("new-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared.swap(client, "new-key")
+
+	if _, err := shared.Do(req, nil); err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if len(got) != 1 || got[0] != "Bearer new-key" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer new-key")
+	}
+}
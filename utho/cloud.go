@@ -4,7 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
+	"net/url"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/uthoplatforms/utho-go/utho"
@@ -18,61 +19,230 @@ const (
 	ProviderName   = "utho"
 	accessTokenEnv = "UTHO_API_KEY"
 	userAgent      = "CCM_USER_AGENT"
+
+	clusterModeManaged   = "managed"
+	clusterModeUnmanaged = "unmanaged"
 )
 
 // Options currently stores the Kubeconfig that was passed in.
 // We can use this to extend any other flags that may have been passed in that we require
 var Options struct {
 	KubeconfigFlag *pflag.Flag
+
+	// WebhookBindAddress enables the Service validation webhook when set.
+	WebhookBindAddress string
+	// WebhookCertFile and WebhookKeyFile hold the TLS serving certificate of the webhook.
+	WebhookCertFile string
+	WebhookKeyFile  string
+	// WebhookCCMServiceAccount is the only user allowed to change the CCM-managed annotations.
+	WebhookCCMServiceAccount string
+
+	// LoadBalancerClassesFile defines additional load balancer classes and their defaults.
+	LoadBalancerClassesFile string
+
+	// DriftCheckInterval is how often load balancers are compared with their services, zero disables the check.
+	DriftCheckInterval time.Duration
+	// DriftAutoCorrect reverts the load balancer changes found by the drift check.
+	DriftAutoCorrect bool
+
+	// ClusterMode is clusterModeManaged for Utho Kubernetes clusters, or
+	// clusterModeUnmanaged for self-managed clusters on Utho cloud instances.
+	ClusterMode string
+
+	// InventoryTTL is how long the node pools and workers of the cluster are cached.
+	InventoryTTL time.Duration
+
+	// NodeAddressFamilies are the IP families of the node addresses published by the CCM.
+	NodeAddressFamilies []string
+
+	// VPCRoutes enables the Routes interface, routing the pod CIDRs in the cluster VPC.
+	VPCRoutes bool
+
+	// APIURL is the base URL of the Utho API, empty for the public API.
+	APIURL string
+	// APIKeySecret is the namespace/name of the Secret the API key is reloaded from, empty to disable reloading.
+	APIKeySecret string
+
+	// Development runs the CCM outside of a Utho cluster, such as against kind
+	// and a stand-in for the Utho API, see validateDevelopment.
+	Development bool
+
+	// ClusterID, ClusterVPC and Region override the cluster ID, VPC and data
+	// center slug otherwise read from the nodes and the Utho API.
+	ClusterID  string
+	ClusterVPC string
+	Region     string
+}
+
+// AddFlags registers the Utho specific flags on fs.
+func AddFlags(fs *pflag.FlagSet) {
+	uthoFlags = fs
+
+	fs.StringVar(&Options.WebhookBindAddress, "utho-webhook-bind-address", "",
+		"Address to serve the Service validating admission webhook on, e.g. :9443. The webhook is disabled if empty.")
+	fs.StringVar(&Options.WebhookCertFile, "utho-webhook-cert-file", "",
+		"File containing the TLS certificate for the validating admission webhook.")
+	fs.StringVar(&Options.WebhookKeyFile, "utho-webhook-key-file", "",
+		"File containing the TLS private key for the validating admission webhook.")
+	fs.StringVar(&Options.WebhookCCMServiceAccount, "utho-webhook-ccm-service-account", defaultCCMServiceAccount,
+		"User name of the cloud controller manager, the only user allowed to change the CCM-managed annotations.")
+	fs.StringVar(&Options.LoadBalancerClassesFile, "utho-load-balancer-classes", "",
+		"YAML file defining load balancer classes and their default annotations, in addition to utho.com/network and utho.com/application.")
+	fs.DurationVar(&Options.DriftCheckInterval, "utho-drift-check-interval", 10*time.Minute,
+		"How often load balancers are compared with the desired state of their services. The check is disabled if 0.")
+	fs.BoolVar(&Options.DriftAutoCorrect, "utho-drift-auto-correct", false,
+		"Revert changes made to load balancers outside of the CCM when the drift check finds them.")
+	fs.StringVar(&Options.ClusterMode, "utho-cluster-mode", clusterModeManaged,
+		"\"managed\" for Utho Kubernetes clusters, or \"unmanaged\" for self-managed clusters running on Utho cloud instances.")
+	fs.DurationVar(&Options.InventoryTTL, "utho-inventory-ttl", time.Minute,
+		"How long the node pools and workers of the cluster are cached between reads of the Utho API.")
+	fs.StringSliceVar(&Options.NodeAddressFamilies, "utho-node-address-families", []string{addressFamilyIPv4, addressFamilyIPv6},
+		"IP families of the node addresses to publish: ipv4, ipv6 or both.")
+	fs.BoolVar(&Options.VPCRoutes, "utho-vpc-routes", false,
+		"Route the pod CIDR of each node to its private IP in the VPC route table, for native-routing CNIs. Requires --configure-cloud-routes.")
+	fs.StringVar(&Options.APIURL, "utho-api-url", "",
+		"Base URL of the Utho API. Defaults to the public API, overridden by the UTHO_API_URL environment variable.")
+	fs.StringVar(&Options.APIKeySecret, "utho-api-key-secret", "kube-system/utho-api-key",
+		"Secret (namespace/name) holding the Utho API key under \"api-key\". Changes to it are applied without a restart. Reloading is disabled if empty.")
+	fs.StringVar(&Options.ClusterID, "utho-cluster-id", "",
+		"ID of the Utho Kubernetes cluster. Found through the Utho API from the node instances if empty.")
+	fs.StringVar(&Options.ClusterVPC, "utho-cluster-vpc", "",
+		"VPC of the cluster. Read from the Utho API if empty.")
+	fs.StringVar(&Options.Region, "utho-region", "",
+		"Data center slug of the cluster, such as inmumbaizone2. Read from the Utho API if empty.")
+	fs.BoolVar(&Options.Development, "utho-development", false,
+		"Run outside of a Utho cluster, for local development: the cluster ID, VPC and region must be set, and the Utho API URL may use plain HTTP.")
+}
+
+// validateDevelopment checks the settings that only development mode relaxes.
+// Outside of a Utho cluster the nodes have none of the labels the cluster
+// identity is otherwise read from, so it has to be given explicitly.
+func validateDevelopment() error {
+	if Options.APIURL != "" {
+		u, err := url.Parse(Options.APIURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("validateDevelopment: invalid Utho API URL %q", Options.APIURL)
+		}
+		if u.Scheme != "https" && !(Options.Development && u.Scheme == "http") {
+			return fmt.Errorf("validateDevelopment: the Utho API URL %q must use https, or http with --utho-development", Options.APIURL)
+		}
+	}
+	if !Options.Development {
+		return nil
+	}
+
+	if Options.ClusterID == "" && !unmanagedMode() {
+		return fmt.Errorf("validateDevelopment: --utho-development requires --utho-cluster-id")
+	}
+	if Options.ClusterVPC == "" || Options.Region == "" {
+		return fmt.Errorf("validateDevelopment: --utho-development requires --utho-cluster-vpc and --utho-region")
+	}
+	apiURL := Options.APIURL
+	if apiURL == "" {
+		apiURL = utho.BaseUrl
+	}
+	klog.Warningf("validateDevelopment: running in development mode against %s, cluster %q, VPC %q, region %q",
+		apiURL, Options.ClusterID, Options.ClusterVPC, Options.Region)
+	return nil
+}
+
+// unmanagedMode returns whether the cluster runs on plain Utho cloud instances
+// rather than being a Utho Kubernetes cluster.
+func unmanagedMode() bool {
+	return Options.ClusterMode == clusterModeUnmanaged
 }
 
 type cloud struct {
-	client        utho.Client
+	client        *sharedClient
+	inventory     *inventory
 	instances     cloudprovider.InstancesV2
 	loadbalancers cloudprovider.LoadBalancer
+	routes        cloudprovider.Routes
 }
 
 func init() {
-	cloudprovider.RegisterCloudProvider(ProviderName, func(_ io.Reader) (i cloudprovider.Interface, err error) {
-		return newCloud()
+	cloudprovider.RegisterCloudProvider(ProviderName, func(config io.Reader) (i cloudprovider.Interface, err error) {
+		return newCloud(config)
 	})
 }
 
-func newCloud() (cloudprovider.Interface, error) {
-	apiToken := os.Getenv(accessTokenEnv)
-	if apiToken == "" {
-		return nil, fmt.Errorf("newCloud: %s must be set in the environment (use a k8s secret)", accessTokenEnv)
+func newCloud(config io.Reader) (cloudprovider.Interface, error) {
+	cfg, err := parseCloudConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("newCloud: %w", err)
 	}
-	debug := os.Getenv("debug")
+	cfg.apply()
 
-	utho, err := utho.NewClient(apiToken)
+	apiToken, err := cfg.apiToken()
 	if err != nil {
-		return nil, fmt.Errorf("newCloud: failed to create utho client: %w", err)
+		return nil, fmt.Errorf("newCloud: %w", err)
 	}
-
-	var dcslug string
-	if debug != "" {
-		dcslug = "inmumbaizone2"
-	} else {
-		clusterId, err := GetLabelValue(nil, "cluster_id")
-		if err != nil {
-			return nil, fmt.Errorf("newCloud: failed to get cluster ID: %w", err)
+	if len(Options.NodeAddressFamilies) == 0 {
+		return nil, fmt.Errorf("newCloud: --utho-node-address-families must list at least one family")
+	}
+	for _, family := range Options.NodeAddressFamilies {
+		if family != addressFamilyIPv4 && family != addressFamilyIPv6 {
+			return nil, fmt.Errorf("newCloud: unknown node address family %q (expected %q or %q)", family, addressFamilyIPv4, addressFamilyIPv6)
 		}
+	}
 
-		dcslug, err = GetDcslug(utho, clusterId)
-		if err != nil {
-			return nil, fmt.Errorf("newCloud: failed to get data center slug: %w", err)
+	if Options.LoadBalancerClassesFile != "" {
+		if err := loadLBClasses(Options.LoadBalancerClassesFile); err != nil {
+			return nil, fmt.Errorf("newCloud: %w", err)
 		}
 	}
 
+	if err := validateDevelopment(); err != nil {
+		return nil, fmt.Errorf("newCloud: %w", err)
+	}
+
+	utho, err := newSharedClient(apiToken)
+	if err != nil {
+		return nil, fmt.Errorf("newCloud: failed to create utho client: %w", err)
+	}
+
+	if Options.ClusterMode != clusterModeManaged && Options.ClusterMode != clusterModeUnmanaged {
+		return nil, fmt.Errorf("newCloud: unknown cluster mode %q (expected %q or %q)", Options.ClusterMode, clusterModeManaged, clusterModeUnmanaged)
+	}
+	if Options.InventoryTTL <= 0 {
+		return nil, fmt.Errorf("newCloud: --utho-inventory-ttl must be positive")
+	}
+	inv := newInventory(utho, Options.InventoryTTL)
+
+	// resolved once, see watchIdentityRefresh
+	if err := inv.refreshIdentity(); err != nil {
+		return nil, fmt.Errorf("newCloud: failed to resolve the cluster identity: %w", err)
+	}
+
 	return &cloud{
 		client:        utho,
-		instances:     newInstancesV2(utho),
-		loadbalancers: newLoadbalancers(utho, dcslug),
+		inventory:     inv,
+		instances:     newInstancesV2(utho, inv),
+		loadbalancers: newLoadbalancers(utho, inv),
+		routes:        newRoutes(utho, inv),
 	}, nil
 }
 
-func (c *cloud) Initialize(_ cloudprovider.ControllerClientBuilder, _ <-chan struct{}) {
+// Initialize starts the background work of the provider. Without a kube
+// client, neither events, nor API key reloads, nor the shared node informer
+// would work, so the CCM exits instead of running without them.
+func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	kubeClient, err := clientBuilder.Client(eventComponent)
+	if err != nil {
+		klog.Fatalf("Initialize: failed to create kube client: %v", err)
+	}
+
+	lbs := c.loadbalancers.(*loadbalancers)
+	lbs.recorder = newEventRecorder(kubeClient, stop)
+	lbs.stop = stop
+
+	if err := startSecretWatcher(c.client, kubeClient, lbs.recorder, stop); err != nil {
+		klog.Errorf("Initialize: the API key will not be reloaded: %v", err)
+	}
+
+	startNodeInformer(kubeClient, stop)
+	go c.inventory.run(stop)
+	go c.inventory.watchIdentityRefresh(stop)
 }
 
 func (c *cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
@@ -101,7 +271,7 @@ func (c *cloud) Clusters() (cloudprovider.Clusters, bool) {
 
 func (c *cloud) Routes() (cloudprovider.Routes, bool) {
 	klog.V(5).Info("called Routes")
-	return nil, false
+	return c.routes, Options.VPCRoutes
 }
 
 func (c *cloud) ProviderName() string {
@@ -0,0 +1,193 @@
+package utho
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// cloudConfigAPIVersion and cloudConfigKind identify the format of the
+	// file passed with --cloud-config. Incompatible changes to the format get
+	// a new version.
+	cloudConfigAPIVersion = "utho.com/v1alpha1"
+	cloudConfigKind       = "CloudConfig"
+
+	// apiURLEnv overrides the base URL of the Utho API.
+	apiURLEnv = "UTHO_API_URL"
+)
+
+// cloudConfig is the format of the file passed with --cloud-config, in YAML or
+// JSON. Every field is optional: unset fields keep the value of their flag.
+// Flags set on the command line take precedence over the file, and the
+// UTHO_API_KEY and UTHO_API_URL environment variables over both.
+type cloudConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	API          cloudConfigAPI          `json:"api,omitempty"`
+	Cluster      cloudConfigCluster      `json:"cluster,omitempty"`
+	LoadBalancer cloudConfigLoadBalancer `json:"loadBalancer,omitempty"`
+	Cache        cloudConfigCache        `json:"cache,omitempty"`
+	Features     cloudConfigFeatures     `json:"features,omitempty"`
+}
+
+type cloudConfigAPI struct {
+	// URL is the value of --utho-api-url.
+	URL string `json:"url,omitempty"`
+	// CredentialsFile is a file holding the API key, used if UTHO_API_KEY is not set.
+	CredentialsFile string `json:"credentialsFile,omitempty"`
+	// KeySecret is the value of --utho-api-key-secret.
+	KeySecret string `json:"keySecret,omitempty"`
+}
+
+type cloudConfigCluster struct {
+	// Mode is "managed" or "unmanaged", see --utho-cluster-mode.
+	Mode string `json:"mode,omitempty"`
+	// ID, VPC and Region are the values of --utho-cluster-id, --utho-cluster-vpc
+	// and --utho-region.
+	ID     string `json:"id,omitempty"`
+	VPC    string `json:"vpc,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+type cloudConfigLoadBalancer struct {
+	// Defaults are utho-loadbalancer-* annotations applied to every load
+	// balancer, overridden by the ones of its class and of its Service.
+	Defaults map[string]string `json:"defaults,omitempty"`
+	// ClassesFile is the file of --utho-load-balancer-classes.
+	ClassesFile string `json:"classesFile,omitempty"`
+}
+
+type cloudConfigCache struct {
+	// InventoryTTL is the value of --utho-inventory-ttl.
+	InventoryTTL *metav1.Duration `json:"inventoryTTL,omitempty"`
+}
+
+type cloudConfigFeatures struct {
+	// DriftCheckInterval and DriftAutoCorrect are the values of
+	// --utho-drift-check-interval and --utho-drift-auto-correct.
+	DriftCheckInterval *metav1.Duration `json:"driftCheckInterval,omitempty"`
+	DriftAutoCorrect   *bool            `json:"driftAutoCorrect,omitempty"`
+	// NodeAddressFamilies is the value of --utho-node-address-families.
+	NodeAddressFamilies []string `json:"nodeAddressFamilies,omitempty"`
+	// VPCRoutes is the value of --utho-vpc-routes.
+	VPCRoutes *bool `json:"vpcRoutes,omitempty"`
+	// Development is the value of --utho-development.
+	Development *bool `json:"development,omitempty"`
+}
+
+// uthoFlags are the flags registered by AddFlags, used to tell the flags set on
+// the command line from their defaults.
+var uthoFlags *pflag.FlagSet
+
+// lbDefaults are the default annotations of every load balancer, from the
+// cloud config.
+var lbDefaults map[string]string
+
+// parseCloudConfig parses and validates the cloud config. A nil reader, when
+// --cloud-config is not set, is an empty config.
+func parseCloudConfig(r io.Reader) (*cloudConfig, error) {
+	cfg := &cloudConfig{}
+	if r == nil {
+		return cfg, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("parseCloudConfig: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parseCloudConfig: %w", err)
+	}
+
+	if cfg.APIVersion != cloudConfigAPIVersion || cfg.Kind != cloudConfigKind {
+		return nil, fmt.Errorf("parseCloudConfig: unsupported config %s/%s (expected apiVersion %q and kind %q)",
+			cfg.APIVersion, cfg.Kind, cloudConfigAPIVersion, cloudConfigKind)
+	}
+	if len(cfg.LoadBalancer.Defaults) > 0 {
+		if err := (lbClass{Type: lbTypeNetwork, Annotations: cfg.LoadBalancer.Defaults}).validate(); err != nil {
+			return nil, fmt.Errorf("parseCloudConfig: loadBalancer.defaults: %w", err)
+		}
+	}
+	if ttl := cfg.Cache.InventoryTTL; ttl != nil && ttl.Duration <= 0 {
+		return nil, fmt.Errorf("parseCloudConfig: cache.inventoryTTL must be positive")
+	}
+	if interval := cfg.Features.DriftCheckInterval; interval != nil && interval.Duration < 0 {
+		return nil, fmt.Errorf("parseCloudConfig: features.driftCheckInterval must not be negative")
+	}
+	return cfg, nil
+}
+
+// apply copies the settings of the config to Options, except the ones whose
+// flag was set on the command line.
+func (cfg *cloudConfig) apply() {
+	setString := func(flag string, target *string, value string) {
+		if value != "" && !flagChanged(flag) {
+			*target = value
+		}
+	}
+	setDuration := func(flag string, target *time.Duration, value *metav1.Duration) {
+		if value != nil && !flagChanged(flag) {
+			*target = value.Duration
+		}
+	}
+
+	setString("utho-cluster-mode", &Options.ClusterMode, cfg.Cluster.Mode)
+	setString("utho-load-balancer-classes", &Options.LoadBalancerClassesFile, cfg.LoadBalancer.ClassesFile)
+	setDuration("utho-inventory-ttl", &Options.InventoryTTL, cfg.Cache.InventoryTTL)
+	setDuration("utho-drift-check-interval", &Options.DriftCheckInterval, cfg.Features.DriftCheckInterval)
+	if cfg.Features.DriftAutoCorrect != nil && !flagChanged("utho-drift-auto-correct") {
+		Options.DriftAutoCorrect = *cfg.Features.DriftAutoCorrect
+	}
+	if len(cfg.Features.NodeAddressFamilies) > 0 && !flagChanged("utho-node-address-families") {
+		Options.NodeAddressFamilies = cfg.Features.NodeAddressFamilies
+	}
+	if cfg.Features.VPCRoutes != nil && !flagChanged("utho-vpc-routes") {
+		Options.VPCRoutes = *cfg.Features.VPCRoutes
+	}
+	if cfg.Features.Development != nil && !flagChanged("utho-development") {
+		Options.Development = *cfg.Features.Development
+	}
+
+	setString("utho-api-url", &Options.APIURL, cfg.API.URL)
+	if url := os.Getenv(apiURLEnv); url != "" {
+		Options.APIURL = url
+	}
+	setString("utho-api-key-secret", &Options.APIKeySecret, cfg.API.KeySecret)
+	setString("utho-cluster-id", &Options.ClusterID, cfg.Cluster.ID)
+	setString("utho-cluster-vpc", &Options.ClusterVPC, cfg.Cluster.VPC)
+	setString("utho-region", &Options.Region, cfg.Cluster.Region)
+
+	lbDefaults = cfg.LoadBalancer.Defaults
+}
+
+// apiToken returns the Utho API key, from UTHO_API_KEY or else the credentials file.
+func (cfg *cloudConfig) apiToken() (string, error) {
+	if token := os.Getenv(accessTokenEnv); token != "" {
+		return token, nil
+	}
+	if cfg.API.CredentialsFile == "" {
+		return "", fmt.Errorf("apiToken: %s must be set in the environment (use a k8s secret), or api.credentialsFile in the cloud config", accessTokenEnv)
+	}
+
+	data, err := os.ReadFile(cfg.API.CredentialsFile)
+	if err != nil {
+		return "", fmt.Errorf("apiToken: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("apiToken: %s is empty", cfg.API.CredentialsFile)
+	}
+	return token, nil
+}
+
+func flagChanged(name string) bool {
+	return uthoFlags != nil && uthoFlags.Changed(name)
+}
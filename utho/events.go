@@ -0,0 +1,84 @@
+package utho
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component set on every Event the CCM records.
+const eventComponent = "utho-cloud-controller-manager"
+
+// Event reasons recorded on Service objects during the load balancer lifecycle.
+const (
+	eventReasonCreatingLB         = "CreatingUthoLB"
+	eventReasonCreatedLB          = "CreatedUthoLB"
+	eventReasonWaitingForInstall  = "WaitingForInstall"
+	eventReasonFrontendCreated    = "FrontendCreated"
+	eventReasonFrontendUpdated    = "FrontendUpdated"
+	eventReasonFrontendDeleted    = "FrontendDeleted"
+	eventReasonBackendCreated     = "BackendCreated"
+	eventReasonBackendDeleted     = "BackendDeleted"
+	eventReasonNoNodePools        = "NoMatchingNodePools"
+	eventReasonDeletedLB          = "DeletedUthoLB"
+	eventReasonStaleLBID          = "StaleLoadBalancerID"
+	eventReasonImmutableChanged   = "ImmutableSettingChanged"
+	eventReasonRecreatingLB       = "RecreatingUthoLB"
+	eventReasonAPIError           = "UthoAPIError"
+	eventReasonInvalidAnnotation  = "InvalidAnnotation"
+	eventReasonUnknownAnnotation  = "UnknownAnnotation"
+	eventReasonAnnotationConflict = "AnnotationConflict"
+	eventReasonDriftDetected      = "LoadBalancerDrift"
+	eventReasonDriftCorrected     = "LoadBalancerDriftCorrected"
+)
+
+// Event reasons recorded on the API key Secret.
+const (
+	eventReasonAPIKeyRotated  = "UthoAPIKeyRotated"
+	eventReasonAPIKeyRejected = "UthoAPIKeyRejected"
+)
+
+// newEventRecorder starts an event broadcaster that writes to the API server
+// and returns a recorder for it. The broadcaster is shut down once stop is closed.
+func newEventRecorder(kubeClient kubernetes.Interface, stop <-chan struct{}) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	go func() {
+		<-stop
+		broadcaster.Shutdown()
+	}()
+
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+// recordEvent records an Event on the service if a recorder has been set up.
+func (l *loadbalancers) recordEvent(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil || service == nil {
+		return
+	}
+	l.recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
+
+// objectRecorder records every event on a fixed object, whichever object it is
+// called with. The Gateway controller uses it to surface the events of the load
+// balancer plumbing, which works on Services, on the Gateway instead.
+type objectRecorder struct {
+	record.EventRecorder
+	object runtime.Object
+}
+
+func (r *objectRecorder) Event(_ runtime.Object, eventType, reason, message string) {
+	r.EventRecorder.Event(r.object, eventType, reason, message)
+}
+
+func (r *objectRecorder) Eventf(_ runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.EventRecorder.Eventf(r.object, eventType, reason, messageFmt, args...)
+}
+
+func (r *objectRecorder) AnnotatedEventf(_ runtime.Object, annotations map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	r.EventRecorder.AnnotatedEventf(r.object, annotations, eventType, reason, messageFmt, args...)
+}
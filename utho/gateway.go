@@ -0,0 +1,1212 @@
+package utho
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// GatewayControllerName is the name of the Gateway API controller in --controllers.
+	GatewayControllerName = "utho-gateway"
+
+	// gatewayClassControllerName is the spec.controllerName of the GatewayClasses handled by the CCM.
+	gatewayClassControllerName = "utho.com/gateway-controller"
+
+	// annoGatewayService marks the in-memory Services built for Gateways, which
+	// must never be written to the API.
+	annoGatewayService = "utho.com/gateway"
+
+	// gatewayFinalizer makes sure the load balancer of a Gateway is deleted with it.
+	gatewayFinalizer = "utho.com/gateway-cleanup"
+
+	// gatewayAPIGroup is the API group of the Gateway API resources.
+	gatewayAPIGroup = "gateway.networking.k8s.io"
+
+	// uthoCertificateGroup and uthoCertificateKind identify certificateRefs that
+	// point at an SSL certificate already uploaded to Utho, by its ID.
+	uthoCertificateGroup = "utho.com"
+	uthoCertificateKind  = "Certificate"
+
+	gatewayResyncPeriod = 5 * time.Minute
+	gatewayWorkers      = 2
+)
+
+var (
+	gatewayClassGVR   = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gatewayclasses"}
+	gatewayGVR        = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+	httpRouteGVR      = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+	tcpRouteGVR       = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1alpha2", Resource: "tcproutes"}
+	tlsRouteGVR       = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1alpha2", Resource: "tlsroutes"}
+	referenceGrantGVR = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "referencegrants"}
+
+	// routeKinds are the kinds of the route resources, by resource.
+	routeKinds = map[schema.GroupVersionResource]string{
+		httpRouteGVR: "HTTPRoute",
+		tcpRouteGVR:  "TCPRoute",
+		tlsRouteGVR:  "TLSRoute",
+	}
+
+	// errRefNotPermitted is returned for references to another namespace that
+	// no ReferenceGrant allows.
+	errRefNotPermitted = fmt.Errorf("no ReferenceGrant allows the reference")
+)
+
+// The types below mirror the parts of the Gateway API resources the controller reads.
+
+type gatewayClass struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ControllerName string `json:"controllerName"`
+	} `json:"spec"`
+}
+
+type gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		GatewayClassName string            `json:"gatewayClassName"`
+		Listeners        []gatewayListener `json:"listeners"`
+	} `json:"spec"`
+	Status gatewayStatus `json:"status"`
+}
+
+type gatewayStatus struct {
+	Addresses  []gatewayAddress        `json:"addresses,omitempty"`
+	Conditions []metav1.Condition      `json:"conditions,omitempty"`
+	Listeners  []gatewayListenerStatus `json:"listeners,omitempty"`
+}
+
+type gatewayAddress struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type gatewayListenerStatus struct {
+	Name           string             `json:"name"`
+	AttachedRoutes int32              `json:"attachedRoutes"`
+	SupportedKinds []routeGroupKind   `json:"supportedKinds"`
+	Conditions     []metav1.Condition `json:"conditions"`
+}
+
+type routeGroupKind struct {
+	Group string `json:"group"`
+	Kind  string `json:"kind"`
+}
+
+type gatewayListener struct {
+	Name     string `json:"name"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	TLS      *struct {
+		Mode            string      `json:"mode"`
+		CertificateRefs []objectRef `json:"certificateRefs"`
+	} `json:"tls"`
+	AllowedRoutes *struct {
+		Namespaces *struct {
+			From     string                `json:"from"`
+			Selector *metav1.LabelSelector `json:"selector"`
+		} `json:"namespaces"`
+		Kinds []routeGroupKind `json:"kinds"`
+	} `json:"allowedRoutes"`
+}
+
+type objectRef struct {
+	Group     string  `json:"group"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Namespace *string `json:"namespace"`
+}
+
+type referenceGrant struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		From []struct {
+			Group     string `json:"group"`
+			Kind      string `json:"kind"`
+			Namespace string `json:"namespace"`
+		} `json:"from"`
+		To []struct {
+			Group string  `json:"group"`
+			Kind  string  `json:"kind"`
+			Name  *string `json:"name"`
+		} `json:"to"`
+	} `json:"spec"`
+}
+
+type gatewayRoute struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []struct {
+			Group       *string `json:"group"`
+			Kind        *string `json:"kind"`
+			Namespace   *string `json:"namespace"`
+			Name        string  `json:"name"`
+			SectionName *string `json:"sectionName"`
+		} `json:"parentRefs"`
+		Rules []struct {
+			BackendRefs []struct {
+				Group     *string `json:"group"`
+				Kind      *string `json:"kind"`
+				Name      string  `json:"name"`
+				Namespace *string `json:"namespace"`
+				Port      *int32  `json:"port"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// routeBackend is a Service port a route attached to a listener sends traffic to.
+type routeBackend struct {
+	namespace string
+	name      string
+	port      int32
+}
+
+// listenerRoutes are the routes attached to a listener and their backends.
+// Backends in another namespace that no ReferenceGrant allows are left out of
+// backends and listed in denied.
+type listenerRoutes struct {
+	attached int32
+	backends []routeBackend
+	denied   []routeBackend
+}
+
+// gatewayController reconciles Gateways of a Utho GatewayClass into Utho load
+// balancers, with one frontend per listener backed by the NodePort of the
+// Service the attached HTTPRoute or TCPRoute points at.
+type gatewayController struct {
+	lbs           *loadbalancers
+	kubeClient    kubernetes.Interface
+	dynamicClient dynamic.Interface
+	informers     dynamicinformer.DynamicSharedInformerFactory
+	queue         workqueue.TypedRateLimitingInterface[string]
+
+	// routeGVRs are the route resources served by the API server. TCPRoute
+	// and TLSRoute are still experimental, and often not installed.
+	routeGVRs []schema.GroupVersionResource
+
+	// referenceGrants is whether the API server serves ReferenceGrants.
+	// Without them, no reference to another namespace is allowed.
+	referenceGrants bool
+}
+
+// StartGatewayController starts the Gateway API controller in the background
+// until ctx is done. The Gateway API resources served by the API server are
+// looked up once: routes whose CRD is installed later need a restart.
+func StartGatewayController(ctx context.Context, cloudProvider cloudprovider.Interface, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface) error {
+	c, ok := cloudProvider.(*cloud)
+	if !ok {
+		return fmt.Errorf("StartGatewayController: unexpected cloud provider %T", cloudProvider)
+	}
+
+	gc := &gatewayController{
+		lbs:           c.loadbalancers.(*loadbalancers),
+		kubeClient:    kubeClient,
+		dynamicClient: dynamicClient,
+		informers:     dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, gatewayResyncPeriod),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: GatewayControllerName},
+		),
+	}
+
+	handlers := map[schema.GroupVersionResource]func(obj interface{}){
+		gatewayClassGVR:   gc.enqueueGatewaysOfClass,
+		gatewayGVR:        gc.enqueueGateway,
+		httpRouteGVR:      gc.enqueueParentGateways,
+		tcpRouteGVR:       gc.enqueueParentGateways,
+		tlsRouteGVR:       gc.enqueueParentGateways,
+		referenceGrantGVR: gc.enqueueAllGateways,
+	}
+	// the resources the controller works without, and what is lost without them
+	optional := map[schema.GroupVersionResource]string{
+		tcpRouteGVR:       "TCP listeners are not supported",
+		tlsRouteGVR:       "TLS listeners are not supported",
+		referenceGrantGVR: "references to other namespaces are not allowed",
+	}
+	for gvr := range handlers {
+		served, err := resourceServed(kubeClient, gvr)
+		if err != nil {
+			return fmt.Errorf("StartGatewayController: %w", err)
+		}
+		switch {
+		case served:
+		case optional[gvr] != "":
+			klog.Infof("StartGatewayController: %s is not installed, %s", gvr, optional[gvr])
+			delete(handlers, gvr)
+		default:
+			return fmt.Errorf("StartGatewayController: the Gateway API CRDs are not installed, %s is not served", gvr)
+		}
+	}
+	for _, gvr := range []schema.GroupVersionResource{httpRouteGVR, tcpRouteGVR, tlsRouteGVR} {
+		if _, ok := handlers[gvr]; ok {
+			gc.routeGVRs = append(gc.routeGVRs, gvr)
+		}
+	}
+	_, gc.referenceGrants = handlers[referenceGrantGVR]
+
+	var synced []cache.InformerSynced
+	for gvr, handler := range handlers {
+		informer := gc.informers.ForResource(gvr).Informer()
+		if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: handler,
+			UpdateFunc: func(old, obj interface{}) {
+				// skip status updates, such as the ones of updateStatus
+				if objectChanged(old, obj) {
+					handler(obj)
+				}
+			},
+			DeleteFunc: handler,
+		}); err != nil {
+			return fmt.Errorf("StartGatewayController: %w", err)
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+
+	gc.informers.Start(ctx.Done())
+
+	go func() {
+		defer utilruntime.HandleCrash()
+		defer gc.queue.ShutDown()
+
+		if !cache.WaitForNamedCacheSync(GatewayControllerName, ctx.Done(), synced...) {
+			return
+		}
+		for i := 0; i < gatewayWorkers; i++ {
+			go wait.UntilWithContext(ctx, gc.worker, time.Second)
+		}
+		<-ctx.Done()
+	}()
+
+	return nil
+}
+
+func (gc *gatewayController) worker(ctx context.Context) {
+	for gc.processNextItem(ctx) {
+	}
+}
+
+func (gc *gatewayController) processNextItem(ctx context.Context) bool {
+	key, quit := gc.queue.Get()
+	if quit {
+		return false
+	}
+	defer gc.queue.Done(key)
+
+	if err := gc.sync(ctx, key); err != nil {
+		klog.Errorf("gatewayController: failed to sync gateway %q: %v", key, err)
+		gc.queue.AddRateLimited(key)
+		return true
+	}
+	gc.queue.Forget(key)
+	return true
+}
+
+func (gc *gatewayController) enqueueGateway(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	gc.queue.Add(key)
+}
+
+func (gc *gatewayController) enqueueGatewaysOfClass(obj interface{}) {
+	class, err := metaAccessor(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	gateways, err := gc.informers.ForResource(gatewayGVR).Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, item := range gateways {
+		gw := &gateway{}
+		if err := fromUnstructured(item, gw); err != nil {
+			continue
+		}
+		if gw.Spec.GatewayClassName == class.GetName() {
+			gc.queue.Add(gw.Namespace + "/" + gw.Name)
+		}
+	}
+}
+
+// enqueueAllGateways enqueues every Gateway, such as when a ReferenceGrant,
+// which may allow references of any of them, changes.
+func (gc *gatewayController) enqueueAllGateways(interface{}) {
+	gateways, err := gc.informers.ForResource(gatewayGVR).Lister().List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, item := range gateways {
+		gc.enqueueGateway(item)
+	}
+}
+
+func (gc *gatewayController) enqueueParentGateways(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	route := &gatewayRoute{}
+	if err := fromUnstructured(obj, route); err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, ref := range route.Spec.ParentRefs {
+		if ref.Kind != nil && *ref.Kind != "Gateway" {
+			continue
+		}
+		namespace := route.Namespace
+		if ref.Namespace != nil {
+			namespace = *ref.Namespace
+		}
+		gc.queue.Add(namespace + "/" + ref.Name)
+	}
+}
+
+// sync reconciles the load balancer and status of a single Gateway.
+func (gc *gatewayController) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	obj, err := gc.informers.ForResource(gatewayGVR).Lister().ByNamespace(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	gw := &gateway{}
+	if err := fromUnstructured(obj, gw); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	ours, err := gc.isUthoGatewayClass(ctx, gw.Spec.GatewayClassName)
+	if err != nil || !ours {
+		return err
+	}
+
+	lbs := gc.loadbalancersFor(obj)
+
+	if gw.DeletionTimestamp != nil {
+		return gc.finalize(ctx, lbs, gw)
+	}
+
+	if !containsString(gw.Finalizers, gatewayFinalizer) {
+		if err := gc.patchFinalizers(ctx, gw, append(gw.Finalizers, gatewayFinalizer)); err != nil {
+			return fmt.Errorf("sync: failed to add finalizer: %w", err)
+		}
+	}
+
+	routes, err := gc.listenerRoutes(ctx, gw)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	service, listenerErrs, err := gc.desiredService(ctx, gw, routes)
+	if err != nil {
+		gc.updateStatus(ctx, gw, "", routes, listenerErrs, err)
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	lb, err := lbs.ensureGatewayLB(ctx, service)
+	if err != nil {
+		gc.updateStatus(ctx, gw, "", routes, listenerErrs, err)
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if gw.Annotations[annoUthoLoadBalancerID] != lb.ID {
+		patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, annoUthoLoadBalancerID, lb.ID)
+		if _, err := gc.dynamicClient.Resource(gatewayGVR).Namespace(gw.Namespace).Patch(ctx, gw.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("sync: failed to set load balancer ID on gateway: %w", err)
+		}
+	}
+
+	// the load balancer no longer uses the certificates of removed or changed listeners
+	if err := gc.deleteCertificates(gw, service.Annotations[annoUthoLBSSLID]); err != nil {
+		klog.Warningf("sync: gateway %s/%s: %v", gw.Namespace, gw.Name, err)
+	}
+
+	gc.updateStatus(ctx, gw, lb.IP, routes, listenerErrs, nil)
+	return nil
+}
+
+// isUthoGatewayClass returns whether the named GatewayClass is handled by the
+// CCM, accepting it if so.
+func (gc *gatewayController) isUthoGatewayClass(ctx context.Context, name string) (bool, error) {
+	obj, err := gc.informers.ForResource(gatewayClassGVR).Lister().Get(name)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("isUthoGatewayClass: %w", err)
+	}
+
+	class := &gatewayClass{}
+	if err := fromUnstructured(obj, class); err != nil {
+		return false, fmt.Errorf("isUthoGatewayClass: %w", err)
+	}
+	if class.Spec.ControllerName != gatewayClassControllerName {
+		return false, nil
+	}
+
+	accepted := metav1.Condition{
+		Type:               "Accepted",
+		Status:             metav1.ConditionTrue,
+		Reason:             "Accepted",
+		Message:            "Handled by the Utho cloud controller manager",
+		ObservedGeneration: class.Generation,
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.(*unstructured.Unstructured).Object, "status", "conditions")
+	if !conditionsContain(conditions, accepted) {
+		if err := gc.patchStatus(ctx, gatewayClassGVR, "", name, map[string]interface{}{
+			"conditions": []metav1.Condition{withTransitionTime(accepted)},
+		}); err != nil {
+			klog.Warningf("isUthoGatewayClass: failed to accept gateway class %q: %v", name, err)
+		}
+	}
+	return true, nil
+}
+
+// desiredService translates a Gateway into the Service the load balancer
+// plumbing works on. Listeners that cannot be programmed are reported in the
+// returned map and left out of the service. A Utho frontend forwards to the
+// node port of a single Service, so listeners whose routes have several
+// backends are rejected.
+func (gc *gatewayController) desiredService(ctx context.Context, gw *gateway, routes map[string]listenerRoutes) (*v1.Service, map[string]error, error) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        gw.Name,
+			Namespace:   gw.Namespace,
+			UID:         gw.UID,
+			Annotations: map[string]string{annoGatewayService: gw.Name},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	for key, value := range gw.Annotations {
+		if strings.HasPrefix(key, annoUthoPrefix) {
+			service.Annotations[key] = value
+		}
+	}
+
+	listenerErrs := map[string]error{}
+	for _, listener := range gw.Spec.Listeners {
+		port := v1.ServicePort{
+			Name:     listener.Name,
+			Protocol: v1.ProtocolTCP,
+			Port:     listener.Port,
+		}
+
+		switch listener.Protocol {
+		case "HTTP":
+			port.AppProtocol = stringPtr(appProtocolHTTP)
+		case "HTTPS":
+			sslID, err := gc.certificateID(ctx, gw, listener)
+			if err != nil {
+				listenerErrs[listener.Name] = err
+				continue
+			}
+			if current := service.Annotations[annoUthoLBSSLID]; current != "" && current != sslID {
+				listenerErrs[listener.Name] = fmt.Errorf("all HTTPS listeners must use the same certificate")
+				continue
+			}
+			service.Annotations[annoUthoLBSSLID] = sslID
+			port.AppProtocol = stringPtr(appProtocolHTTPS)
+		case "TCP":
+			if !gc.servesRoutes(tcpRouteGVR) {
+				listenerErrs[listener.Name] = fmt.Errorf("TCPRoute (%s) is not installed", tcpRouteGVR.Version)
+				continue
+			}
+		case "TLS":
+			// passed through to the backends as is, a TCP frontend cannot terminate TLS
+			if listener.TLS == nil || listener.TLS.Mode != "Passthrough" {
+				listenerErrs[listener.Name] = fmt.Errorf("TLS listeners only support tls.mode Passthrough, use an HTTPS listener to terminate TLS")
+				continue
+			}
+			if !gc.servesRoutes(tlsRouteGVR) {
+				listenerErrs[listener.Name] = fmt.Errorf("TLSRoute (%s) is not installed", tlsRouteGVR.Version)
+				continue
+			}
+		default:
+			listenerErrs[listener.Name] = fmt.Errorf("unsupported listener protocol %q", listener.Protocol)
+			continue
+		}
+
+		routeBackends := routes[listener.Name].backends
+		if denied := routes[listener.Name].denied; len(routeBackends) == 0 && len(denied) > 0 {
+			listenerErrs[listener.Name] = fmt.Errorf("backend service %s/%s is in another namespace: %w", denied[0].namespace, denied[0].name, errRefNotPermitted)
+			continue
+		}
+		if len(routeBackends) == 0 {
+			listenerErrs[listener.Name] = fmt.Errorf("no route with a backend is attached to the listener")
+			continue
+		}
+		if len(routeBackends) > 1 {
+			listenerErrs[listener.Name] = fmt.Errorf("the routes of the listener have %d backends, Utho load balancers only support one Service port per listener", len(routeBackends))
+			continue
+		}
+
+		nodePort, err := gc.nodePort(ctx, routeBackends[0])
+		if err != nil {
+			listenerErrs[listener.Name] = err
+			continue
+		}
+		port.NodePort = nodePort
+
+		service.Spec.Ports = append(service.Spec.Ports, port)
+	}
+
+	if len(service.Spec.Ports) == 0 {
+		return nil, listenerErrs, fmt.Errorf("desiredService: gateway %s/%s has no listener that can be programmed", gw.Namespace, gw.Name)
+	}
+	return service, listenerErrs, nil
+}
+
+// listenerRoutes maps the listeners of a Gateway to the routes attached to
+// them and the distinct Service ports they send traffic to. Routes only attach
+// to the listeners whose allowedRoutes accept them.
+func (gc *gatewayController) listenerRoutes(ctx context.Context, gw *gateway) (map[string]listenerRoutes, error) {
+	result := map[string]listenerRoutes{}
+
+	namespaces := map[string]labels.Set{}
+	namespaceLabels := func(name string) (labels.Set, error) {
+		if set, ok := namespaces[name]; ok {
+			return set, nil
+		}
+		ns, err := gc.kubeClient.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		namespaces[name] = labels.Set(ns.Labels)
+		return namespaces[name], nil
+	}
+
+	for _, gvr := range gc.routeGVRs {
+		kind := routeKinds[gvr]
+		items, err := gc.informers.ForResource(gvr).Lister().List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("listenerRoutes: %w", err)
+		}
+
+		for _, item := range items {
+			route := &gatewayRoute{}
+			if err := fromUnstructured(item, route); err != nil {
+				continue
+			}
+
+			attached := map[string]bool{}
+			for _, ref := range route.Spec.ParentRefs {
+				namespace := route.Namespace
+				if ref.Namespace != nil {
+					namespace = *ref.Namespace
+				}
+				if (ref.Kind != nil && *ref.Kind != "Gateway") || namespace != gw.Namespace || ref.Name != gw.Name {
+					continue
+				}
+				for _, listener := range gw.Spec.Listeners {
+					if ref.SectionName != nil && *ref.SectionName != listener.Name {
+						continue
+					}
+					if !routeMatchesListener(gvr, listener.Protocol) {
+						continue
+					}
+					allowed, err := routeAllowed(listener, gw.Namespace, kind, route.Namespace, namespaceLabels)
+					if err != nil {
+						return nil, fmt.Errorf("listenerRoutes: %s %s/%s: %w", kind, route.Namespace, route.Name, err)
+					}
+					if allowed {
+						attached[listener.Name] = true
+					}
+				}
+			}
+
+			for listener := range attached {
+				lr := result[listener]
+				lr.attached++
+				for _, rule := range route.Spec.Rules {
+					for _, backend := range rule.BackendRefs {
+						if (backend.Kind != nil && *backend.Kind != "Service") || (backend.Group != nil && *backend.Group != "") || backend.Port == nil {
+							continue
+						}
+						rb := routeBackend{namespace: route.Namespace, name: backend.Name, port: *backend.Port}
+						if backend.Namespace != nil {
+							rb.namespace = *backend.Namespace
+						}
+						if rb.namespace != route.Namespace {
+							granted, err := gc.referenceGranted(kind, route.Namespace, "Service", rb.namespace, rb.name)
+							if err != nil {
+								return nil, fmt.Errorf("listenerRoutes: %w", err)
+							}
+							if !granted {
+								if !containsBackend(lr.denied, rb) {
+									lr.denied = append(lr.denied, rb)
+								}
+								continue
+							}
+						}
+						if !containsBackend(lr.backends, rb) {
+							lr.backends = append(lr.backends, rb)
+						}
+					}
+				}
+				result[listener] = lr
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// routeAllowed returns whether the allowedRoutes of a listener accept routes of
+// a kind from a namespace. By default, a listener accepts the routes of the
+// namespace of its Gateway, of any kind its protocol supports.
+func routeAllowed(listener gatewayListener, gatewayNamespace, kind, namespace string, namespaceLabels func(string) (labels.Set, error)) (bool, error) {
+	from := "Same"
+	var selector *metav1.LabelSelector
+	if allowed := listener.AllowedRoutes; allowed != nil {
+		if len(allowed.Kinds) > 0 {
+			found := false
+			for _, k := range allowed.Kinds {
+				found = found || ((k.Group == "" || k.Group == gatewayAPIGroup) && k.Kind == kind)
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		if allowed.Namespaces != nil && allowed.Namespaces.From != "" {
+			from, selector = allowed.Namespaces.From, allowed.Namespaces.Selector
+		}
+	}
+
+	switch from {
+	case "All":
+		return true, nil
+	case "Selector":
+		sel, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			klog.Warningf("routeAllowed: listener %q has an invalid namespace selector: %v", listener.Name, err)
+			return false, nil
+		}
+		set, err := namespaceLabels(namespace)
+		if err != nil {
+			return false, fmt.Errorf("routeAllowed: namespace %s: %w", namespace, err)
+		}
+		return sel.Matches(set), nil
+	default:
+		return namespace == gatewayNamespace, nil
+	}
+}
+
+// referenceGranted returns whether a ReferenceGrant in the namespace of a
+// core object, such as a Service or a Secret, allows objects of the Gateway
+// API kind fromKind in fromNamespace to refer to it.
+func (gc *gatewayController) referenceGranted(fromKind, fromNamespace, toKind, toNamespace, toName string) (bool, error) {
+	if !gc.referenceGrants {
+		return false, nil
+	}
+
+	items, err := gc.informers.ForResource(referenceGrantGVR).Lister().ByNamespace(toNamespace).List(labels.Everything())
+	if err != nil {
+		return false, fmt.Errorf("referenceGranted: %w", err)
+	}
+	grants := make([]referenceGrant, 0, len(items))
+	for _, item := range items {
+		grant := referenceGrant{}
+		if err := fromUnstructured(item, &grant); err != nil {
+			continue
+		}
+		grants = append(grants, grant)
+	}
+	return grantsAllow(grants, fromKind, fromNamespace, toKind, toName), nil
+}
+
+// grantsAllow returns whether one of the ReferenceGrants of a namespace allows
+// objects of the Gateway API kind fromKind in fromNamespace to refer to the
+// core object toKind/toName.
+func grantsAllow(grants []referenceGrant, fromKind, fromNamespace, toKind, toName string) bool {
+	for _, grant := range grants {
+		from := false
+		for _, f := range grant.Spec.From {
+			from = from || (f.Group == gatewayAPIGroup && f.Kind == fromKind && f.Namespace == fromNamespace)
+		}
+		if !from {
+			continue
+		}
+		for _, t := range grant.Spec.To {
+			if t.Group == "" && t.Kind == toKind && (t.Name == nil || *t.Name == toName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsBackend(list []routeBackend, b routeBackend) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// servesRoutes returns whether the API server serves a route resource.
+func (gc *gatewayController) servesRoutes(gvr schema.GroupVersionResource) bool {
+	for _, served := range gc.routeGVRs {
+		if served == gvr {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMatchesListener returns whether routes of the given resource can attach
+// to a listener of the given protocol.
+func routeMatchesListener(gvr schema.GroupVersionResource, protocol string) bool {
+	switch gvr {
+	case httpRouteGVR:
+		return protocol == "HTTP" || protocol == "HTTPS"
+	case tcpRouteGVR:
+		return protocol == "TCP"
+	case tlsRouteGVR:
+		return protocol == "TLS"
+	}
+	return false
+}
+
+// listenerRouteKind returns the kind of the routes a listener of the given
+// protocol supports.
+func listenerRouteKind(protocol string) string {
+	switch protocol {
+	case "TCP":
+		return routeKinds[tcpRouteGVR]
+	case "TLS":
+		return routeKinds[tlsRouteGVR]
+	}
+	return routeKinds[httpRouteGVR]
+}
+
+// nodePort returns the NodePort of a route backend's Service port.
+func (gc *gatewayController) nodePort(ctx context.Context, backend routeBackend) (int32, error) {
+	svc, err := gc.kubeClient.CoreV1().Services(backend.namespace).Get(ctx, backend.name, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("nodePort: backend service %s/%s: %w", backend.namespace, backend.name, err)
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Port == backend.port {
+			if port.NodePort == 0 {
+				return 0, fmt.Errorf("nodePort: backend service %s/%s port %d has no node port, use a NodePort service",
+					backend.namespace, backend.name, backend.port)
+			}
+			return port.NodePort, nil
+		}
+	}
+	return 0, fmt.Errorf("nodePort: backend service %s/%s has no port %d", backend.namespace, backend.name, backend.port)
+}
+
+// certificateID resolves the first certificateRef of an HTTPS listener to a Utho
+// SSL certificate ID. A utho.com/Certificate ref names the ID directly, while a
+// TLS Secret is uploaded to Utho under a name derived from the Gateway and the
+// Secret content, see gatewayCertificatePrefix. A Secret in another namespace
+// needs a ReferenceGrant allowing the Gateway to use it.
+func (gc *gatewayController) certificateID(ctx context.Context, gw *gateway, listener gatewayListener) (string, error) {
+	if listener.TLS == nil || len(listener.TLS.CertificateRefs) == 0 {
+		return "", fmt.Errorf("certificateID: HTTPS listener %q has no certificateRefs", listener.Name)
+	}
+
+	ref := listener.TLS.CertificateRefs[0]
+	if ref.Group == uthoCertificateGroup && ref.Kind == uthoCertificateKind {
+		return ref.Name, nil
+	}
+	if ref.Group != "" || (ref.Kind != "" && ref.Kind != "Secret") {
+		return "", fmt.Errorf("certificateID: unsupported certificateRef %s/%s", ref.Group, ref.Kind)
+	}
+
+	namespace := gw.Namespace
+	if ref.Namespace != nil {
+		namespace = *ref.Namespace
+	}
+	if namespace != gw.Namespace {
+		granted, err := gc.referenceGranted("Gateway", gw.Namespace, "Secret", namespace, ref.Name)
+		if err != nil {
+			return "", fmt.Errorf("certificateID: %w", err)
+		}
+		if !granted {
+			return "", fmt.Errorf("certificateID: secret %s/%s is in another namespace: %w", namespace, ref.Name, errRefNotPermitted)
+		}
+	}
+	secret, err := gc.kubeClient.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("certificateID: %w", err)
+	}
+
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return "", fmt.Errorf("certificateID: secret %s/%s is not a TLS secret", namespace, ref.Name)
+	}
+
+	sum := sha256.Sum256(append(append([]byte{}, cert...), key...))
+	certName := gatewayCertificatePrefix(gw) + hex.EncodeToString(sum[:])[:16]
+
+	certs, err := gc.lbs.client.Ssl().List()
+	if err != nil {
+		return "", fmt.Errorf("certificateID: failed to list certificates: %w", err)
+	}
+	for _, c := range certs {
+		if c.Name == certName {
+			return c.ID, nil
+		}
+	}
+
+	created, err := gc.lbs.client.Ssl().Create(utho.CreateSslParams{
+		Name:           certName,
+		Type:           "custom",
+		CertificateKey: string(cert),
+		PrivateKey:     string(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("certificateID: failed to upload certificate from secret %s/%s: %w", namespace, ref.Name, err)
+	}
+	klog.Infof("certificateID: uploaded certificate %q from secret %s/%s", certName, namespace, ref.Name)
+	return created.ID, nil
+}
+
+// gatewayCertificatePrefix starts the names of the certificates uploaded to Utho
+// for a Gateway, so that they can be deleted once the Gateway no longer uses them.
+func gatewayCertificatePrefix(gw *gateway) string {
+	sum := sha256.Sum256([]byte(gw.UID))
+	return "k8s-" + hex.EncodeToString(sum[:])[:8] + "-"
+}
+
+// deleteCertificates deletes the certificates uploaded to Utho for a Gateway,
+// except the one with ID keep.
+func (gc *gatewayController) deleteCertificates(gw *gateway, keep string) error {
+	certs, err := gc.lbs.client.Ssl().List()
+	if err != nil {
+		return fmt.Errorf("deleteCertificates: failed to list certificates: %w", err)
+	}
+
+	prefix := gatewayCertificatePrefix(gw)
+	var errs []error
+	for _, c := range certs {
+		if !strings.HasPrefix(c.Name, prefix) || c.ID == keep {
+			continue
+		}
+		if _, err := gc.lbs.client.Ssl().Delete(c.ID); err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete certificate %q: %w", c.Name, err))
+			continue
+		}
+		klog.Infof("deleteCertificates: deleted certificate %q of gateway %s/%s", c.Name, gw.Namespace, gw.Name)
+	}
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return fmt.Errorf("deleteCertificates: %w", err)
+	}
+	return nil
+}
+
+// finalize deletes the load balancer of a Gateway being deleted, and the
+// certificates uploaded for it, and releases it.
+func (gc *gatewayController) finalize(ctx context.Context, lbs *loadbalancers, gw *gateway) error {
+	if !containsString(gw.Finalizers, gatewayFinalizer) {
+		return nil
+	}
+
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        gw.Name,
+		Namespace:   gw.Namespace,
+		UID:         gw.UID,
+		Annotations: map[string]string{annoGatewayService: gw.Name},
+	}}
+	for key, value := range gw.Annotations {
+		if strings.HasPrefix(key, annoUthoPrefix) {
+			service.Annotations[key] = value
+		}
+	}
+	if err := lbs.EnsureLoadBalancerDeleted(ctx, "", service); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	if err := gc.deleteCertificates(gw, ""); err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+
+	return gc.patchFinalizers(ctx, gw, removeString(gw.Finalizers, gatewayFinalizer))
+}
+
+// updateStatus publishes the load balancer address and the Accepted and
+// Programmed conditions of a Gateway and its listeners, along with the
+// ResolvedRefs condition of the listeners. Conditions keep their
+// transition time while their status does not change, and the status is only
+// patched if it changed, as the patch triggers another sync.
+func (gc *gatewayController) updateStatus(ctx context.Context, gw *gateway, ip string, routes map[string]listenerRoutes, listenerErrs map[string]error, syncErr error) {
+	programmed := metav1.Condition{
+		Type:               "Programmed",
+		Status:             metav1.ConditionTrue,
+		Reason:             "Programmed",
+		Message:            "Utho load balancer is configured",
+		ObservedGeneration: gw.Generation,
+	}
+	if syncErr != nil {
+		programmed.Status = metav1.ConditionFalse
+		programmed.Reason = "Invalid"
+		programmed.Message = syncErr.Error()
+	}
+	accepted := metav1.Condition{
+		Type:               "Accepted",
+		Status:             metav1.ConditionTrue,
+		Reason:             "Accepted",
+		ObservedGeneration: gw.Generation,
+	}
+
+	status := gatewayStatus{Addresses: gw.Status.Addresses}
+	if ip != "" {
+		status.Addresses = []gatewayAddress{{Type: "IPAddress", Value: ip}}
+	}
+	status.Conditions = append([]metav1.Condition(nil), gw.Status.Conditions...)
+	meta.SetStatusCondition(&status.Conditions, accepted)
+	meta.SetStatusCondition(&status.Conditions, programmed)
+
+	for _, listener := range gw.Spec.Listeners {
+		cond := programmed
+		resolved := metav1.Condition{
+			Type:               "ResolvedRefs",
+			Status:             metav1.ConditionTrue,
+			Reason:             "ResolvedRefs",
+			ObservedGeneration: gw.Generation,
+		}
+		if err, ok := listenerErrs[listener.Name]; ok {
+			cond.Status = metav1.ConditionFalse
+			cond.Reason = "Invalid"
+			cond.Message = err.Error()
+			if errors.Is(err, errRefNotPermitted) {
+				resolved.Status = metav1.ConditionFalse
+				resolved.Reason = "RefNotPermitted"
+				resolved.Message = err.Error()
+			}
+		}
+
+		var conditions []metav1.Condition
+		for _, current := range gw.Status.Listeners {
+			if current.Name == listener.Name {
+				conditions = append(conditions, current.Conditions...)
+			}
+		}
+		meta.SetStatusCondition(&conditions, accepted)
+		meta.SetStatusCondition(&conditions, cond)
+		meta.SetStatusCondition(&conditions, resolved)
+
+		status.Listeners = append(status.Listeners, gatewayListenerStatus{
+			Name:           listener.Name,
+			AttachedRoutes: routes[listener.Name].attached,
+			SupportedKinds: []routeGroupKind{{Group: gatewayAPIGroup, Kind: listenerRouteKind(listener.Protocol)}},
+			Conditions:     conditions,
+		})
+	}
+
+	if apiequality.Semantic.DeepEqual(gw.Status, status) {
+		return
+	}
+	if err := gc.patchStatus(ctx, gatewayGVR, gw.Namespace, gw.Name, status); err != nil {
+		klog.Warningf("updateStatus: failed to update status of gateway %s/%s: %v", gw.Namespace, gw.Name, err)
+	}
+}
+
+// loadbalancersFor returns a copy of the load balancer plumbing that records its
+// events on the given object rather than on the Service it is called with.
+func (gc *gatewayController) loadbalancersFor(obj runtime.Object) *loadbalancers {
+	lbs := *gc.lbs
+	if lbs.recorder != nil {
+		lbs.recorder = &objectRecorder{EventRecorder: lbs.recorder, object: obj}
+	}
+	return &lbs
+}
+
+func (gc *gatewayController) patchFinalizers(ctx context.Context, gw *gateway, finalizers []string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": gw.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = gc.dynamicClient.Resource(gatewayGVR).Namespace(gw.Namespace).Patch(ctx, gw.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (gc *gatewayController) patchStatus(ctx context.Context, gvr schema.GroupVersionResource, namespace, name string, status interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	_, err = gc.dynamicClient.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// ensureGatewayLB creates the load balancer of a Gateway, or syncs its frontends
+// if it exists already. Unlike EnsureLoadBalancer it never writes to the
+// Service, which only exists in memory.
+func (l *loadbalancers) ensureGatewayLB(ctx context.Context, service *v1.Service) (*utho.Loadbalancer, error) {
+	cfg, err := l.parseConfig(service)
+	if err != nil {
+		return nil, fmt.Errorf("ensureGatewayLB: %w", err)
+	}
+
+	if err := l.GetKubeClient(); err != nil {
+		return nil, fmt.Errorf("ensureGatewayLB: failed to get kubeclient: %w", err)
+	}
+	clusterId, nodePoolId, err := l.clusterBackendInfo(service, cfg, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ensureGatewayLB: %w", err)
+	}
+
+	lb, err := l.getUthoLB(ctx, service)
+	if err == errLbNotFound {
+		vpcId, err := l.inventory.vpcID()
+		if err != nil {
+			return nil, fmt.Errorf("ensureGatewayLB: failed to get VPC ID: %w", err)
+		}
+
+		lbName := l.GetLoadBalancerName(ctx, "", service)
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonCreatingLB, "Creating Utho load balancer %q", lbName)
+		created, err := l.CreateUthoLoadBalancer(lbName, vpcId, service, nodePoolId, clusterId)
+		if err != nil {
+			return nil, fmt.Errorf("ensureGatewayLB: failed to create load-balancer: %w", err)
+		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonCreatedLB, "Created Utho load balancer %q (%s)", lbName, created.ID)
+
+		lb, err = l.client.Loadbalancers().Read(created.ID)
+		if err != nil {
+			return nil, fmt.Errorf("ensureGatewayLB: failed to get Utho LoadBalancer with ID: %w", err)
+		}
+		return lb, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ensureGatewayLB: %w", err)
+	}
+
+	if err := l.syncLoadBalancer(lb, service, cfg, nodePoolId, clusterId); err != nil {
+		return nil, fmt.Errorf("ensureGatewayLB: %w", err)
+	}
+	return lb, nil
+}
+
+func fromUnstructured(obj interface{}, into interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object %T", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, into)
+}
+
+func metaAccessor(obj interface{}) (metav1.Object, error) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	return meta.Accessor(obj)
+}
+
+// conditionsContain returns whether an unstructured condition list already has
+// the condition with the same status, reason and generation.
+func conditionsContain(conditions []interface{}, want metav1.Condition) bool {
+	for _, c := range conditions {
+		m, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if m["type"] == want.Type && m["status"] == string(want.Status) && m["reason"] == want.Reason &&
+			fmt.Sprint(m["observedGeneration"]) == fmt.Sprint(want.ObservedGeneration) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectChanged reports whether an update of an object changed more than its
+// status. Resyncs, which do not change the object, are let through.
+func objectChanged(old, obj interface{}) bool {
+	oldMeta, err := metaAccessor(old)
+	if err != nil {
+		return true
+	}
+	newMeta, err := metaAccessor(obj)
+	if err != nil {
+		return true
+	}
+	return oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() ||
+		oldMeta.GetGeneration() != newMeta.GetGeneration() ||
+		!apiequality.Semantic.DeepEqual(oldMeta.GetAnnotations(), newMeta.GetAnnotations()) ||
+		!apiequality.Semantic.DeepEqual(oldMeta.GetFinalizers(), newMeta.GetFinalizers()) ||
+		!oldMeta.GetDeletionTimestamp().Equal(newMeta.GetDeletionTimestamp())
+}
+
+// resourceServed returns whether the API server serves a resource.
+func resourceServed(kubeClient kubernetes.Interface, gvr schema.GroupVersionResource) (bool, error) {
+	resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("resourceServed: %w", err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func withTransitionTime(c metav1.Condition) metav1.Condition {
+	c.LastTransitionTime = metav1.Now()
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
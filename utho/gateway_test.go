@@ -0,0 +1,105 @@
+package utho
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestRouteAllowed(t *testing.T) {
+	namespaceLabels := func(name string) (labels.Set, error) {
+		switch name {
+		case "team-a":
+			return labels.Set{"gateway-access": "true"}, nil
+		case "team-b":
+			return labels.Set{}, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	tests := []struct {
+		name      string
+		listener  string
+		kind      string
+		namespace string
+		want      bool
+	}{
+		{name: "same namespace by default", listener: `{}`, kind: "HTTPRoute", namespace: "infra", want: true},
+		{name: "other namespace by default", listener: `{}`, kind: "HTTPRoute", namespace: "team-a"},
+		{name: "same", listener: `{"allowedRoutes":{"namespaces":{"from":"Same"}}}`, kind: "HTTPRoute", namespace: "team-a"},
+		{name: "all", listener: `{"allowedRoutes":{"namespaces":{"from":"All"}}}`, kind: "HTTPRoute", namespace: "team-a", want: true},
+		{
+			name:      "selector matches",
+			listener:  `{"allowedRoutes":{"namespaces":{"from":"Selector","selector":{"matchLabels":{"gateway-access":"true"}}}}}`,
+			kind:      "HTTPRoute",
+			namespace: "team-a",
+			want:      true,
+		},
+		{
+			name:      "selector does not match",
+			listener:  `{"allowedRoutes":{"namespaces":{"from":"Selector","selector":{"matchLabels":{"gateway-access":"true"}}}}}`,
+			kind:      "HTTPRoute",
+			namespace: "team-b",
+		},
+		{name: "selector missing", listener: `{"allowedRoutes":{"namespaces":{"from":"Selector"}}}`, kind: "HTTPRoute", namespace: "team-a"},
+		{name: "kind allowed", listener: `{"allowedRoutes":{"kinds":[{"kind":"TLSRoute"}]}}`, kind: "TLSRoute", namespace: "infra", want: true},
+		{name: "kind not allowed", listener: `{"allowedRoutes":{"kinds":[{"group":"gateway.networking.k8s.io","kind":"TCPRoute"}]}}`, kind: "TLSRoute", namespace: "infra"},
+		{name: "kind of another group", listener: `{"allowedRoutes":{"kinds":[{"group":"example.com","kind":"TLSRoute"}]}}`, kind: "TLSRoute", namespace: "infra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var listener gatewayListener
+			if err := json.Unmarshal([]byte(tt.listener), &listener); err != nil {
+				t.Fatal(err)
+			}
+			got, err := routeAllowed(listener, "infra", tt.kind, tt.namespace, namespaceLabels)
+			if err != nil {
+				t.Fatalf("routeAllowed() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("routeAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantsAllow(t *testing.T) {
+	var grants []referenceGrant
+	if err := json.Unmarshal([]byte(`[
+		{"spec":{
+			"from":[{"group":"gateway.networking.k8s.io","kind":"Gateway","namespace":"infra"}],
+			"to":[{"group":"","kind":"Secret","name":"web-tls"}]
+		}},
+		{"spec":{
+			"from":[{"group":"gateway.networking.k8s.io","kind":"HTTPRoute","namespace":"team-a"}],
+			"to":[{"group":"","kind":"Service"}]
+		}}
+	]`), &grants); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		fromKind      string
+		fromNamespace string
+		toKind        string
+		toName        string
+		want          bool
+	}{
+		{name: "named secret", fromKind: "Gateway", fromNamespace: "infra", toKind: "Secret", toName: "web-tls", want: true},
+		{name: "other secret", fromKind: "Gateway", fromNamespace: "infra", toKind: "Secret", toName: "api-tls"},
+		{name: "other gateway namespace", fromKind: "Gateway", fromNamespace: "team-a", toKind: "Secret", toName: "web-tls"},
+		{name: "any service", fromKind: "HTTPRoute", fromNamespace: "team-a", toKind: "Service", toName: "web", want: true},
+		{name: "other route kind", fromKind: "TCPRoute", fromNamespace: "team-a", toKind: "Service", toName: "web"},
+		{name: "other kind", fromKind: "HTTPRoute", fromNamespace: "team-a", toKind: "Secret", toName: "web-tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := grantsAllow(grants, tt.fromKind, tt.fromNamespace, tt.toKind, tt.toName); got != tt.want {
+				t.Errorf("grantsAllow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
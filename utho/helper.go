@@ -3,76 +3,139 @@ package utho
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/uthoplatforms/utho-go/utho"
 	"golang.org/x/exp/rand"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
-// GetLabelValue fetches `labelKey` from the first node that carries it.
-func GetLabelValue(clientset kubernetes.Interface, labelKey string) (string, error) {
-	if clientset == nil {
-		var err error
-		clientset, err = GetKubeClient()
-		if err != nil {
-			return "", fmt.Errorf("GetLabelValue: %w", err)
-		}
-	}
+// nodeInformerResync is the resync period of the shared node informer.
+const nodeInformerResync = 10 * time.Minute
 
-	nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+// GetNodePoolsID retrieves all unique node pool IDs from the nodes in the cluster
+func GetNodePoolsID() ([]string, error) {
+	pools, err := GetNodePools(labels.Everything())
 	if err != nil {
-		return "", fmt.Errorf("GetLabelValue: %w", err)
-	}
-	if len(nodes.Items) == 0 {
-		return "", fmt.Errorf("GetLabelValue: cluster has no nodes")
+		return nil, fmt.Errorf("GetNodePoolsID: %w", err)
 	}
 
-	for _, n := range nodes.Items {
-		if v := n.Labels[labelKey]; v != "" {
-			return v, nil
-		}
+	// Convert map keys to a slice
+	uniqueNodePoolIDs := make([]string, 0, len(pools))
+	for id := range pools {
+		uniqueNodePoolIDs = append(uniqueNodePoolIDs, id)
 	}
 
-	return "", fmt.Errorf("GetLabelValue: label %q not found on any of %d nodes",
-		labelKey, len(nodes.Items))
+	return uniqueNodePoolIDs, nil
 }
 
-// GetNodePoolsID retrieves all unique node pool IDs from the nodes in the cluster
-func GetNodePoolsID() ([]string, error) {
-	clientset, err := GetKubeClient()
+// GetNodePools groups the nodes matching selector by node pool ID. In unmanaged
+// mode, where every instance is a backend of its own, nodes are grouped by
+// instance ID instead.
+func GetNodePools(selector labels.Selector) (map[string][]v1.Node, error) {
+	nodes, err := listNodes()
 	if err != nil {
-		return nil, fmt.Errorf("GetNodePoolsID: error creating Kubernetes client: %w", err)
+		return nil, fmt.Errorf("GetNodePools: %w", err)
 	}
+	return groupNodes(nodes, selector, unmanagedMode()), nil
+}
 
-	nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("GetNodePoolsID: error retrieving nodes: %w", err)
-	}
+// nodeCache holds the lister of the shared node informer started by
+// startNodeInformer, nil until its cache has synced.
+var nodeCache struct {
+	sync.RWMutex
+	lister corelisters.NodeLister
+}
 
-	if len(nodes.Items) == 0 {
-		return nil, fmt.Errorf("GetNodePoolsID: no nodes found in the cluster")
-	}
+// startNodeInformer starts the node informer shared by the load balancer,
+// instance and route code in the background until stop is closed.
+func startNodeInformer(kubeClient kubernetes.Interface, stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(kubeClient, nodeInformerResync)
+	informer := factory.Core().V1().Nodes()
+	lister := informer.Lister()
+	hasSynced := informer.Informer().HasSynced
+	factory.Start(stop)
+
+	go func() {
+		if !cache.WaitForNamedCacheSync("utho-nodes", stop, hasSynced) {
+			return
+		}
+		nodeCache.Lock()
+		nodeCache.lister = lister
+		nodeCache.Unlock()
+	}()
+}
+
+// listNodes returns every node of the cluster, from the shared node informer
+// once it has synced. Before that, such as while the cluster identity is
+// resolved at startup, the nodes are listed from the API server.
+func listNodes() ([]v1.Node, error) {
+	nodeCache.RLock()
+	lister := nodeCache.lister
+	nodeCache.RUnlock()
+
+	var items []v1.Node
+	if lister != nil {
+		nodes, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("listNodes: error listing nodes: %w", err)
+		}
+		for _, node := range nodes {
+			items = append(items, *node)
+		}
+	} else {
+		clientset, err := GetKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("listNodes: error creating Kubernetes client: %w", err)
+		}
 
-	nodePoolIDs := make(map[string]struct{})
-	for _, node := range nodes.Items {
-		labels := node.GetLabels()
-		if nodePoolId, exists := labels["nodepool_id"]; exists {
-			nodePoolIDs[nodePoolId] = struct{}{}
+		nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("listNodes: error retrieving nodes: %w", err)
 		}
+		items = nodes.Items
 	}
 
-	// Convert map keys to a slice
-	uniqueNodePoolIDs := make([]string, 0, len(nodePoolIDs))
-	for id := range nodePoolIDs {
-		uniqueNodePoolIDs = append(uniqueNodePoolIDs, id)
+	if len(items) == 0 {
+		return nil, fmt.Errorf("listNodes: no nodes found in the cluster")
 	}
+	return items, nil
+}
 
-	return uniqueNodePoolIDs, nil
+// groupNodes groups the nodes matching selector by node pool ID or, if
+// byInstance is set, by the instance ID of their provider ID.
+func groupNodes(nodes []v1.Node, selector labels.Selector, byInstance bool) map[string][]v1.Node {
+	pools := make(map[string][]v1.Node)
+	for _, node := range nodes {
+		nodeLabels := node.GetLabels()
+		if !selector.Matches(labels.Set(nodeLabels)) {
+			continue
+		}
+		if byInstance {
+			if node.Spec.ProviderID == "" {
+				// not initialized by the CCM yet
+				continue
+			}
+			if id, err := getInstanceIDFromProviderID(&node); err == nil {
+				pools[id] = append(pools[id], node)
+			}
+			continue
+		}
+		if nodePoolId, exists := nodeLabels["nodepool_id"]; exists {
+			pools[nodePoolId] = append(pools[nodePoolId], node)
+		}
+	}
+	return pools
 }
 
 func GetDcslug(client utho.Client, clusterId string) (string, error) {
@@ -105,14 +168,25 @@ func GetK8sInstance(client utho.Client, clusterID, instanceID string) (*utho.Wor
 	if err != nil {
 		return nil, fmt.Errorf("GetK8sInstance: %w", err)
 	}
-	for _, pool := range cluster.Nodepools {
+	worker, _, err := findK8sWorker(cluster, instanceID)
+	return worker, err
+}
+
+// findK8sWorker returns a worker node of a cluster and the ID of its node pool.
+func findK8sWorker(cluster *utho.KubernetesCluster, instanceID string) (*utho.WorkerNode, string, error) {
+	for key, pool := range cluster.Nodepools {
 		for idx := range pool.Workers {
-			if pool.Workers[idx].ID == instanceID {
-				return &pool.Workers[idx], nil
+			if pool.Workers[idx].ID != instanceID {
+				continue
+			}
+			poolID := pool.Id
+			if poolID == "" {
+				poolID = key
 			}
+			return &pool.Workers[idx], poolID, nil
 		}
 	}
-	return nil, cloudprovider.InstanceNotFound
+	return nil, "", cloudprovider.InstanceNotFound
 }
 
 func GetKubeClient() (*kubernetes.Clientset, error) {
@@ -0,0 +1,213 @@
+package utho
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// clusterIdentity is the cluster the CCM manages load balancers and nodes for.
+type clusterIdentity struct {
+	// ClusterID is the Utho Kubernetes cluster ID, empty in unmanaged mode.
+	ClusterID string
+	VPC       string
+	Dcslug    string
+}
+
+// identityLabels are the node labels of Utho Kubernetes clusters that have to
+// agree with the resolved identity.
+var identityLabels = map[string]func(*clusterIdentity) string{
+	"cluster_id":     func(id *clusterIdentity) string { return id.ClusterID },
+	"cluster_vpc":    func(id *clusterIdentity) string { return id.VPC },
+	"cluster_dcslug": func(id *clusterIdentity) string { return id.Dcslug },
+}
+
+// resolveIdentity resolves the cluster identity from Options, set by flags or
+// the cloud config, and the Utho API for the parts that are not set. The node
+// labels are only used to cross-check the result: any node labelled with
+// another cluster, VPC or data center fails the resolution, rather than the
+// CCM managing the load balancers of another cluster.
+func (inv *inventory) resolveIdentity() (*clusterIdentity, error) {
+	id := &clusterIdentity{
+		ClusterID: Options.ClusterID,
+		VPC:       Options.ClusterVPC,
+		Dcslug:    Options.Region,
+	}
+
+	nodes, err := listNodes()
+	if err != nil {
+		return nil, fmt.Errorf("resolveIdentity: %w", err)
+	}
+
+	if unmanagedMode() {
+		id.ClusterID = ""
+		if id.VPC == "" || id.Dcslug == "" {
+			instance, err := inv.nodeInstance()
+			if err != nil {
+				return nil, fmt.Errorf("resolveIdentity: %w", err)
+			}
+			if id.VPC == "" {
+				id.VPC = workerFromCloudInstance(instance).PrivateNetwork.Vpc
+			}
+			if id.Dcslug == "" {
+				id.Dcslug = instance.Dclocation.Dc
+			}
+		}
+	} else if id.ClusterID == "" || id.VPC == "" || id.Dcslug == "" {
+		cluster, err := inv.findCluster(id.ClusterID, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("resolveIdentity: %w", err)
+		}
+		id.ClusterID = cluster.Info.Cluster.ID
+		if id.VPC == "" {
+			id.VPC = cluster.Info.Cluster.Vpc
+		}
+		if id.VPC == "" && len(cluster.Vpc) > 0 {
+			id.VPC = cluster.Vpc[0].ID
+		}
+		if id.Dcslug == "" {
+			id.Dcslug = cluster.Info.Cluster.Dcslug
+		}
+	}
+
+	if id.VPC == "" {
+		return nil, fmt.Errorf("resolveIdentity: the VPC of the cluster is unknown, set --utho-cluster-vpc")
+	}
+	if id.Dcslug == "" {
+		return nil, fmt.Errorf("resolveIdentity: the data center of the cluster is unknown, set --utho-region")
+	}
+	if err := checkIdentityLabels(id, nodes); err != nil {
+		return nil, fmt.Errorf("resolveIdentity: %w", err)
+	}
+	return id, nil
+}
+
+// findCluster reads the cluster with the given ID or, if it is empty, finds the
+// cluster whose workers are the nodes, by their provider ID or node_id label.
+func (inv *inventory) findCluster(clusterID string, nodes []v1.Node) (*utho.KubernetesCluster, error) {
+	if clusterID != "" {
+		cluster, err := inv.client.Kubernetes().Read(clusterID)
+		if err != nil {
+			return nil, fmt.Errorf("findCluster: failed to read cluster %s: %w", clusterID, err)
+		}
+		return cluster, nil
+	}
+
+	instanceIDs := make(map[string]bool)
+	for idx := range nodes {
+		if nodes[idx].Spec.ProviderID != "" {
+			if id, err := getInstanceIDFromProviderID(&nodes[idx]); err == nil {
+				instanceIDs[id] = true
+			}
+		} else if id := nodes[idx].Labels[nodeIDLabel]; id != "" {
+			instanceIDs[id] = true
+		}
+	}
+	if len(instanceIDs) == 0 {
+		return nil, fmt.Errorf("findCluster: no node has a provider ID or %s label, set --utho-cluster-id", nodeIDLabel)
+	}
+
+	clusters, err := inv.client.Kubernetes().List()
+	if err != nil {
+		return nil, fmt.Errorf("findCluster: failed to list clusters: %w", err)
+	}
+	for _, k8s := range clusters {
+		cluster, err := inv.client.Kubernetes().Read(k8s.ID)
+		if err != nil {
+			return nil, fmt.Errorf("findCluster: failed to read cluster %s: %w", k8s.ID, err)
+		}
+		for _, pool := range cluster.Nodepools {
+			for _, worker := range pool.Workers {
+				if instanceIDs[worker.ID] {
+					return cluster, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("findCluster: none of the %d clusters of the account has the nodes as workers, set --utho-cluster-id", len(clusters))
+}
+
+// checkIdentityLabels fails if any node carries an identity label that
+// disagrees with id.
+func checkIdentityLabels(id *clusterIdentity, nodes []v1.Node) error {
+	for _, node := range nodes {
+		for label, value := range identityLabels {
+			if v, ok := node.Labels[label]; ok && v != "" && v != value(id) {
+				return fmt.Errorf("checkIdentityLabels: node %s has %s=%q but the cluster resolved to %q, refusing to manage another cluster",
+					node.Name, label, v, value(id))
+			}
+		}
+	}
+	return nil
+}
+
+// identity returns the resolved cluster identity.
+func (inv *inventory) identity() (*clusterIdentity, error) {
+	inv.identityMu.RLock()
+	defer inv.identityMu.RUnlock()
+
+	if inv.id == nil {
+		return nil, fmt.Errorf("identity: the cluster identity was not resolved")
+	}
+	return inv.id, nil
+}
+
+// refreshIdentity resolves the cluster identity again. On failure, the
+// previous identity stays in place.
+func (inv *inventory) refreshIdentity() error {
+	id, err := inv.resolveIdentity()
+	if err != nil {
+		return fmt.Errorf("refreshIdentity: %w", err)
+	}
+
+	inv.identityMu.Lock()
+	previous := inv.id
+	inv.id = id
+	inv.identityMu.Unlock()
+
+	if previous != nil && *previous != *id {
+		klog.Warningf("refreshIdentity: cluster identity changed from %+v to %+v", *previous, *id)
+		// the cached cluster is the previous one
+		inv.mu.Lock()
+		inv.cluster, inv.fetched = nil, time.Time{}
+		inv.mu.Unlock()
+	}
+	klog.Infof("refreshIdentity: cluster %q, VPC %q, data center %q", id.ClusterID, id.VPC, id.Dcslug)
+	return nil
+}
+
+// watchIdentityRefresh resolves the cluster identity again whenever the CCM
+// receives SIGHUP, until stop is closed.
+func (inv *inventory) watchIdentityRefresh(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-signals:
+			klog.Info("watchIdentityRefresh: SIGHUP received, resolving the cluster identity again")
+			if err := inv.refreshIdentity(); err != nil {
+				klog.Errorf("watchIdentityRefresh: keeping the previous cluster identity: %v", err)
+			}
+		}
+	}
+}
+
+// checkNodeIdentity fails if a node, such as one that joined after the
+// identity was resolved, is labelled with another cluster.
+func (inv *inventory) checkNodeIdentity(node *v1.Node) error {
+	id, err := inv.identity()
+	if err != nil {
+		return err
+	}
+	return checkIdentityLabels(id, []v1.Node{*node})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/uthoplatforms/utho-go/utho"
@@ -19,31 +20,32 @@ import (
 
 const (
 	nodeIDLabel = "node_id"
+
+	// Labels set on nodes from the Utho API, unlike the ones set by the installer.
+	nodePoolLabel = "utho.com/node-pool"
+	planLabel     = "utho.com/plan"
+	cpuModelLabel = "utho.com/cpu-model"
+
+	// addressFamilyIPv4 and addressFamilyIPv6 are the values of --utho-node-address-families.
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
 )
 
 var _ cloudprovider.InstancesV2 = &instancesv2{}
 
 type instancesv2 struct {
-	client utho.Client
+	client    utho.Client
+	inventory *inventory
 
 	kubeClient kubernetes.Interface
 }
 
-func newInstancesV2(client utho.Client) cloudprovider.InstancesV2 {
-	return &instancesv2{client, nil}
+func newInstancesV2(client utho.Client, inv *inventory) cloudprovider.InstancesV2 {
+	return &instancesv2{client: client, inventory: inv}
 }
 
 func (i *instancesv2) InstanceExists(ctx context.Context, node *v1.Node) (bool, error) {
-	if err := i.GetKubeClient(); err != nil {
-		return false, fmt.Errorf("InstanceExists: failed to init kube client: %w", err)
-	}
-
-	clusterID, err := GetLabelValue(i.kubeClient, "cluster_id")
-	if err != nil {
-		return false, fmt.Errorf("InstanceExists: failed to read cluster_id: %w", err)
-	}
-
-	k8sNode, err := i.getInstanceById(node, clusterID)
+	k8sNode, err := i.getInstanceById(node)
 	if err != nil {
 		if errors.Is(err, cloudprovider.InstanceNotFound) {
 			return false, nil
@@ -59,66 +61,160 @@ func (i *instancesv2) InstanceExists(ctx context.Context, node *v1.Node) (bool,
 
 // InstanceShutdown checks whether the instance is running or powered off.
 func (i *instancesv2) InstanceShutdown(ctx context.Context, node *v1.Node) (bool, error) {
-	if err := i.GetKubeClient(); err != nil {
-		return false, fmt.Errorf("InstanceShutdown: failed to get kubeclient: %w", err)
-	}
-	// Retrieve the cluster ID
-	clusterId, err := GetLabelValue(i.kubeClient, "cluster_id")
-	if err != nil {
-		return false, fmt.Errorf("InstanceShutdown: failed to get cluster ID: %w", err)
-	}
-
 	// Fetch the instance information
-	newNode, err := i.getInstanceById(node, clusterId)
+	newNode, err := i.getInstanceById(node)
 	if err != nil {
 		klog.Errorf("InstanceShutdown: instance(%s) shutdown check failed: %v", node.Spec.ProviderID, err)
 		return false, fmt.Errorf("InstanceShutdown: failed to get instance by ID: %w", err)
 	}
 
-	// Check the instance status
-	if newNode.Status != "Installed" {
-		return true, nil // Instance is not running
+	// The power state is only known to the cloud instances, a worker missing
+	// from them is judged by its worker state alone
+	var powerStatus string
+	instance, err := i.inventory.cloudInstance(newNode.ID, "")
+	switch {
+	case err == nil:
+		powerStatus = instance.Powerstatus
+	case !errors.Is(err, cloudprovider.InstanceNotFound):
+		return false, fmt.Errorf("InstanceShutdown: %w", err)
 	}
 
-	return false, nil // Instance is running
+	shutdown, err := instanceShutdown(powerStatus, newNode.Status)
+	if err != nil {
+		return false, fmt.Errorf("InstanceShutdown: instance %s: %w", newNode.ID, err)
+	}
+	return shutdown, nil
+}
+
+// instanceShutdownStates maps the lower-cased power and worker states of Utho
+// instances to whether the instance is shut down. Instances that are still
+// installing, rebooting or resizing are not: they come back on their own, and
+// the shutdown taint would get their volumes detached.
+var instanceShutdownStates = map[string]bool{
+	// running
+	"running":   false,
+	"online":    false,
+	"installed": false,
+	"active":    false,
+
+	// transitioning
+	"pending":    false,
+	"installing": false,
+	"rebooting":  false,
+	"restarting": false,
+	"resizing":   false,
+	"upgrading":  false,
+
+	// not running
+	"powered off": true,
+	"poweroff":    true,
+	"stopped":     true,
+	"offline":     true,
+	"suspended":   true,
+	"failed":      true,
+}
+
+// instanceShutdown returns whether an instance is shut down according to any of
+// its states. Empty states are ignored, unknown ones are an error rather than a guess.
+func instanceShutdown(states ...string) (bool, error) {
+	known := false
+	for _, state := range states {
+		if state == "" {
+			continue
+		}
+		shutdown, ok := instanceShutdownStates[strings.ToLower(strings.TrimSpace(state))]
+		if !ok {
+			return false, fmt.Errorf("unknown instance state %q", state)
+		}
+		if shutdown {
+			return true, nil
+		}
+		known = true
+	}
+	if !known {
+		return false, fmt.Errorf("instance state is not reported")
+	}
+	return false, nil
 }
 
 // InstanceMetadata returns a struct of type InstanceMetadata containing the node information.
 func (i *instancesv2) InstanceMetadata(ctx context.Context, node *v1.Node) (*cloudprovider.InstanceMetadata, error) {
-	if err := i.GetKubeClient(); err != nil {
-		return nil, fmt.Errorf("InstanceMetadata: failed to get kubeclient: %w", err)
-	}
-	// Retrieve the cluster ID
-	clusterId, err := GetLabelValue(i.kubeClient, "cluster_id")
-	if err != nil {
-		return nil, fmt.Errorf("InstanceMetadata: failed to get cluster ID: %w", err)
+	if err := i.inventory.checkNodeIdentity(node); err != nil {
+		return nil, fmt.Errorf("InstanceMetadata: %w", err)
 	}
 
-	// Retrieve the data center slug
-	slug, err := GetLabelValue(i.kubeClient, "cluster_dcslug")
-	if err != nil {
-		return nil, fmt.Errorf("InstanceMetadata: failed to get data center slug: %w", err)
+	var (
+		k8sNode    *utho.WorkerNode
+		poolID     string
+		slug, zone string
+	)
+	if unmanagedMode() {
+		// Fetch the instance information
+		instance, err := i.getCloudInstance(node)
+		if err != nil {
+			klog.Errorf("InstanceMetadata: instance(%s) metadata retrieval failed: %v", node.Spec.ProviderID, err)
+			return nil, fmt.Errorf("InstanceMetadata: %w", err)
+		}
+		k8sNode = workerFromCloudInstance(instance)
+		slug, zone = instance.Dclocation.Dc, instance.Dclocation.Dc
+	} else {
+		// Retrieve the data center slug
+		var err error
+		slug, err = i.inventory.dcslug()
+		if err != nil {
+			return nil, fmt.Errorf("InstanceMetadata: failed to get data center slug: %w", err)
+		}
+
+		// Fetch the instance information
+		id, err := getInstanceIDFromProviderID(node)
+		if err != nil {
+			return nil, fmt.Errorf("InstanceMetadata: %w", err)
+		}
+		var cluster *utho.KubernetesCluster
+		k8sNode, poolID, cluster, err = i.inventory.worker(id)
+		if err != nil {
+			klog.Errorf("InstanceMetadata: instance(%s) metadata retrieval failed: %v", node.Spec.ProviderID, err)
+			return nil, fmt.Errorf("InstanceMetadata: failed to get instance by ID: %w", err)
+		}
+
+		// Every node of a cluster is in its data center, which is the zone
+		zone = cluster.Info.Cluster.Dcslug
+		if zone == "" {
+			zone = slug
+		}
 	}
 
-	// Fetch the instance information
-	k8sNode, err := i.getInstanceById(node, clusterId)
+	details, err := i.getInstanceDetails(k8sNode.ID)
 	if err != nil {
-		klog.Errorf("InstanceMetadata: instance(%s) metadata retrieval failed: %v", node.Spec.ProviderID, err)
-		return nil, fmt.Errorf("InstanceMetadata: failed to get instance by ID: %w", err)
+		// the addresses and labels known from the cluster are still worth publishing
+		klog.Warningf("InstanceMetadata: failed to get details of instance %s: %v", k8sNode.ID, err)
 	}
 
 	// Retrieve node instance addresses
-	nodeAddress, err := i.nodeInstanceAddresses(k8sNode)
+	nodeAddress, err := i.nodeInstanceAddresses(k8sNode, details)
 	if err != nil {
 		return nil, fmt.Errorf("InstanceMetadata: failed to get node instance addresses: %w", err)
 	}
 
+	labels := map[string]string{}
+	if poolID != "" {
+		labels[nodePoolLabel] = poolID
+	}
+	if k8sNode.Planid != "" {
+		labels[planLabel] = k8sNode.Planid
+	}
+	if details != nil && details.Cpumodel != "" {
+		labels[cpuModelLabel] = details.Cpumodel
+	}
+
 	// Construct the InstanceMetadata struct
 	uthoNode := cloudprovider.InstanceMetadata{
-		ProviderID:    fmt.Sprintf("utho://%s", k8sNode.ID),
-		InstanceType:  k8sNode.Planid,
-		Region:        slug,
-		NodeAddresses: nodeAddress,
+		ProviderID:       fmt.Sprintf("utho://%s", k8sNode.ID),
+		InstanceType:     k8sNode.Planid,
+		Region:           slug,
+		Zone:             zone,
+		NodeAddresses:    nodeAddress,
+		AdditionalLabels: labels,
 	}
 
 	// Log the returned metadata
@@ -126,8 +222,10 @@ func (i *instancesv2) InstanceMetadata(ctx context.Context, node *v1.Node) (*clo
 	return &uthoNode, nil
 }
 
-// nodeInstanceAddresses gathers public/private IP addresses and returns a []v1.NodeAddress.
-func (i *instancesv2) nodeInstanceAddresses(instance *utho.WorkerNode) ([]v1.NodeAddress, error) {
+// nodeInstanceAddresses gathers the private IPs as InternalIP, the public IPs as
+// ExternalIP and the hostname of an instance, restricted to the address families
+// in Options.NodeAddressFamilies. Unset addresses are left out.
+func (i *instancesv2) nodeInstanceAddresses(instance *utho.WorkerNode, details *instanceDetails) ([]v1.NodeAddress, error) {
 	var addresses []v1.NodeAddress
 	if instance == nil {
 		return nil, fmt.Errorf("nodeInstanceAddresses: instance is nil")
@@ -137,22 +235,109 @@ func (i *instancesv2) nodeInstanceAddresses(instance *utho.WorkerNode) ([]v1.Nod
 		return nil, fmt.Errorf("nodeInstanceAddresses: require public or private IP")
 	}
 
-	addresses = append(addresses,
-		v1.NodeAddress{Type: v1.NodeInternalIP, Address: instance.PrivateNetwork.Ip},
-		// v1.NodeAddress{Type: v1.NodeExternalIP, Address: instance.PrivateNetwork.Ip},
-	)
+	addIP := func(addrType v1.NodeAddressType, addr string) {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			if addr != "" {
+				klog.Warningf("nodeInstanceAddresses: ignoring invalid IP %q of instance %s", addr, instance.ID)
+			}
+			return
+		}
+		family := addressFamilyIPv4
+		if ip.To4() == nil {
+			family = addressFamilyIPv6
+		}
+		if !containsString(Options.NodeAddressFamilies, family) {
+			return
+		}
+		for _, a := range addresses {
+			if a.Address == ip.String() {
+				return
+			}
+		}
+		addresses = append(addresses, v1.NodeAddress{Type: addrType, Address: ip.String()})
+	}
+
+	addIP(v1.NodeInternalIP, instance.PrivateNetwork.Ip)
+	addIP(v1.NodeExternalIP, instance.Ip)
+
+	if details != nil {
+		for _, addr := range details.Networks.Private.V6 {
+			addIP(v1.NodeInternalIP, addr.IPAddress)
+		}
+		for _, addr := range details.Networks.Public.V6 {
+			addIP(v1.NodeExternalIP, addr.IPAddress)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("nodeInstanceAddresses: instance %s has no %s address", instance.ID, strings.Join(Options.NodeAddressFamilies, " or "))
+	}
+
+	if hostname := strings.TrimSpace(instance.Hostname); hostname != "" {
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: hostname})
+	}
 
 	return addresses, nil
 }
 
-// getInstanceById attempts to obtain a Utho instance from the Utho API.
-func (i *instancesv2) getInstanceById(node *v1.Node, clusterID string) (*utho.WorkerNode, error) {
+// instanceDetails holds the settings of an instance that the SDK does not decode.
+type instanceDetails struct {
+	Cpumodel string `json:"cpumodel"`
+	Networks struct {
+		Public struct {
+			V6 []ipv6Address `json:"v6"`
+		} `json:"public"`
+		Private struct {
+			V6 []ipv6Address `json:"v6"`
+		} `json:"private"`
+	} `json:"networks"`
+}
+
+type ipv6Address struct {
+	IPAddress string `json:"ip_address"`
+}
+
+// getInstanceDetails returns the CPU model and IPv6 addresses of an instance.
+func (i *instancesv2) getInstanceDetails(instanceID string) (*instanceDetails, error) {
+	req, err := i.client.NewRequest("GET", "cloud/"+instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("getInstanceDetails: %w", err)
+	}
+
+	var res struct {
+		Cloud   []instanceDetails `json:"cloud"`
+		Status  string            `json:"status"`
+		Message string            `json:"message"`
+	}
+	if _, err := i.client.Do(req, &res); err != nil {
+		return nil, fmt.Errorf("getInstanceDetails: %w", err)
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, fmt.Errorf("getInstanceDetails: %s", res.Message)
+	}
+	if len(res.Cloud) == 0 {
+		return nil, fmt.Errorf("getInstanceDetails: %w", cloudprovider.InstanceNotFound)
+	}
+	return &res.Cloud[0], nil
+}
+
+// getInstanceById attempts to obtain a Utho instance from the cluster inventory.
+func (i *instancesv2) getInstanceById(node *v1.Node) (*utho.WorkerNode, error) {
+	if unmanagedMode() {
+		instance, err := i.getCloudInstance(node)
+		if err != nil {
+			return nil, err
+		}
+		return workerFromCloudInstance(instance), nil
+	}
+
 	id, err := getInstanceIDFromProviderID(node)
 	if err != nil {
 		return nil, fmt.Errorf("getInstanceById: %w", err)
 	}
 
-	newNode, err := GetK8sInstance(i.client, clusterID, id)
+	newNode, _, _, err := i.inventory.worker(id)
 	if err != nil {
 		if errors.Is(err, cloudprovider.InstanceNotFound) {
 			return nil, err
@@ -196,21 +381,47 @@ func setProviderID(node *v1.Node, c kubernetes.Interface) error {
 	return err
 }
 
-// getInstanceByName retrieves a Utho instance for a given NodeName.
-// Returns an error if multiple nodes with the same name exist.
-func getInstanceByName(client utho.Client, nodeName types.NodeName) (*utho.CloudInstance, error) {
-	list, err := client.CloudInstances().List()
-	if err != nil {
-		return nil, fmt.Errorf("getInstanceByName: failed to list cloud instances: %w", err)
+// getCloudInstance retrieves the Utho cloud instance of a node in unmanaged
+// mode, by provider ID or, for nodes that have none yet, by hostname.
+func (i *instancesv2) getCloudInstance(node *v1.Node) (*utho.CloudInstance, error) {
+	var id string
+	if node.Spec.ProviderID != "" {
+		var err error
+		if id, err = getInstanceIDFromProviderID(node); err != nil {
+			return nil, fmt.Errorf("getCloudInstance: %w", err)
+		}
 	}
 
-	for _, instance := range list {
-		if instance.Hostname == string(nodeName) {
-			return &instance, nil
+	instance, err := i.inventory.cloudInstance(id, node.Name)
+	if err != nil {
+		if errors.Is(err, cloudprovider.InstanceNotFound) {
+			return nil, err
 		}
+		return nil, fmt.Errorf("getCloudInstance: %w", err)
 	}
+	return instance, nil
+}
 
-	return nil, fmt.Errorf("getInstanceByName: cloudprovider.InstanceNotFound")
+// workerFromCloudInstance describes a cloud instance as a cluster worker, so
+// that unmanaged nodes go through the same code as managed ones.
+func workerFromCloudInstance(instance *utho.CloudInstance) *utho.WorkerNode {
+	worker := &utho.WorkerNode{
+		ID:       instance.ID,
+		Hostname: instance.Hostname,
+		Ip:       instance.IP,
+		Status:   instance.Status,
+		PrivateNetwork: utho.PrivateNetwork{
+			Ip:  instance.V4Private.IPAddress,
+			Vpc: instance.V4Private.VpcID,
+		},
+	}
+	for _, private := range instance.Networks.Private.V4 {
+		if worker.PrivateNetwork.Ip != "" {
+			break
+		}
+		worker.PrivateNetwork.Ip, worker.PrivateNetwork.Vpc = private.IPAddress, private.VpcID
+	}
+	return worker
 }
 
 func (l *instancesv2) GetKubeClient() error {
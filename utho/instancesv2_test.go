@@ -0,0 +1,40 @@
+package utho
+
+import "testing"
+
+func TestInstanceShutdown(t *testing.T) {
+	type testCase struct {
+		name     string
+		states   []string
+		shutdown bool
+		wantErr  bool
+	}
+	tests := []testCase{
+		{name: "no states", wantErr: true},
+		{name: "empty states", states: []string{"", ""}, wantErr: true},
+		{name: "unknown state", states: []string{"hibernating"}, wantErr: true},
+		{name: "unknown worker state", states: []string{"running", "hibernating"}, wantErr: true},
+		{name: "mixed case", states: []string{"Powered Off"}, shutdown: true},
+		{name: "upper case", states: []string{"RUNNING"}},
+		{name: "surrounding spaces", states: []string{" stopped "}, shutdown: true},
+		{name: "empty power state", states: []string{"", "Active"}},
+		{name: "empty worker state", states: []string{"poweroff", ""}, shutdown: true},
+		{name: "running worker of a stopped instance", states: []string{"stopped", "active"}, shutdown: true},
+		{name: "stopped worker of a running instance", states: []string{"running", "stopped"}, shutdown: true},
+	}
+	for state, shutdown := range instanceShutdownStates {
+		tests = append(tests, testCase{name: state, states: []string{state}, shutdown: shutdown})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := instanceShutdown(tt.states...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("instanceShutdown(%q) error = %v, want error %v", tt.states, err, tt.wantErr)
+			}
+			if shutdown != tt.shutdown {
+				t.Errorf("instanceShutdown(%q) = %v, want %v", tt.states, shutdown, tt.shutdown)
+			}
+		})
+	}
+}
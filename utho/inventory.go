@@ -0,0 +1,267 @@
+package utho
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	"k8s.io/apimachinery/pkg/util/wait"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// inventoryMissRefresh is the minimum age of the cached cluster before a
+// lookup of an unknown worker refreshes it, so that lookups of deleted
+// instances do not each read the whole cluster.
+const inventoryMissRefresh = 5 * time.Second
+
+// inventory caches the node pools and workers of the cluster, read with a
+// single Kubernetes().Read, the cloud instances of the account, which carry the
+// power state of the workers, and the identity of the cluster. In unmanaged
+// mode, it only caches the cloud instances. It is shared by
+// instancesv2 and loadbalancers, which would otherwise list every node and
+// read the whole cluster for each node they look at.
+type inventory struct {
+	client utho.Client
+	ttl    time.Duration
+
+	// refreshMu serializes the reads of the Utho API, while mu only guards the
+	// cached data, so that lookups served from the cache never wait for a read.
+	// The cluster and the cloud instances are read separately, the instances
+	// only when a lookup needs them.
+	refreshMu        sync.Mutex
+	mu               sync.Mutex
+	cluster          *utho.KubernetesCluster
+	fetched          time.Time
+	instances        []utho.CloudInstance
+	instancesFetched time.Time
+
+	identityMu sync.RWMutex
+	id         *clusterIdentity
+}
+
+func newInventory(client utho.Client, ttl time.Duration) *inventory {
+	return &inventory{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+// run refreshes the cached cluster, or the cloud instances in unmanaged mode,
+// in the background until stop is closed.
+func (inv *inventory) run(stop <-chan struct{}) {
+	wait.Until(func() {
+		if unmanagedMode() {
+			if err := inv.refreshInstances(0); err != nil {
+				klog.Warningf("inventory: failed to refresh cloud instances: %v", err)
+			}
+			return
+		}
+		if err := inv.refresh(0); err != nil {
+			klog.Warningf("inventory: failed to refresh cluster: %v", err)
+		}
+	}, inv.ttl, stop)
+}
+
+// clusterID returns the ID of the Utho Kubernetes cluster, empty in unmanaged mode.
+func (inv *inventory) clusterID() (string, error) {
+	id, err := inv.identity()
+	if err != nil {
+		return "", fmt.Errorf("clusterID: %w", err)
+	}
+	return id.ClusterID, nil
+}
+
+// vpcID returns the VPC of the cluster nodes.
+func (inv *inventory) vpcID() (string, error) {
+	id, err := inv.identity()
+	if err != nil {
+		return "", fmt.Errorf("vpcID: %w", err)
+	}
+	return id.VPC, nil
+}
+
+// dcslug returns the data center of the cluster.
+func (inv *inventory) dcslug() (string, error) {
+	id, err := inv.identity()
+	if err != nil {
+		return "", fmt.Errorf("dcslug: %w", err)
+	}
+	return id.Dcslug, nil
+}
+
+// nodeInstance returns the cloud instance of one of the nodes, whose VPC and
+// data center are the ones of the cluster in unmanaged mode. Nodes are matched
+// by provider ID or, as none may have one before the CCM initializes them, by
+// hostname.
+func (inv *inventory) nodeInstance() (*utho.CloudInstance, error) {
+	nodes, err := listNodes()
+	if err != nil {
+		return nil, fmt.Errorf("nodeInstance: %w", err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("nodeInstance: the cluster has no nodes")
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	for idx := range nodes {
+		var instanceID string
+		if nodes[idx].Spec.ProviderID != "" {
+			id, err := getInstanceIDFromProviderID(&nodes[idx])
+			if err != nil {
+				continue
+			}
+			instanceID = id
+		}
+		instance, err := inv.cloudInstance(instanceID, nodes[idx].Name)
+		if err == nil {
+			return instance, nil
+		}
+		if !errors.Is(err, cloudprovider.InstanceNotFound) {
+			return nil, fmt.Errorf("nodeInstance: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("nodeInstance: no node matches a cloud instance by provider ID or hostname")
+}
+
+// getCluster returns the cluster, read again if the cached one is older than the TTL.
+func (inv *inventory) getCluster() (*utho.KubernetesCluster, error) {
+	if err := inv.refresh(inv.ttl); err != nil {
+		return nil, fmt.Errorf("getCluster: %w", err)
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.cluster, nil
+}
+
+// worker returns a worker of the cluster, the ID of its node pool and the
+// cluster. A worker missing from the cached cluster, such as a node that was
+// just added, causes the cluster to be read again.
+func (inv *inventory) worker(instanceID string) (*utho.WorkerNode, string, *utho.KubernetesCluster, error) {
+	cluster, err := inv.getCluster()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("worker: %w", err)
+	}
+	w, poolID, err := findK8sWorker(cluster, instanceID)
+	if errors.Is(err, cloudprovider.InstanceNotFound) {
+		if err := inv.refresh(inventoryMissRefresh); err != nil {
+			return nil, "", nil, fmt.Errorf("worker: %w", err)
+		}
+		if cluster, err = inv.getCluster(); err != nil {
+			return nil, "", nil, fmt.Errorf("worker: %w", err)
+		}
+		w, poolID, err = findK8sWorker(cluster, instanceID)
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return w, poolID, cluster, nil
+}
+
+// cloudInstance returns a cloud instance by ID or, if instanceID is empty, by
+// hostname. An instance missing from the cache causes it to be read again.
+func (inv *inventory) cloudInstance(instanceID, hostname string) (*utho.CloudInstance, error) {
+	if err := inv.refreshInstances(inv.ttl); err != nil {
+		return nil, fmt.Errorf("cloudInstance: %w", err)
+	}
+
+	instance := inv.findCloudInstance(instanceID, hostname)
+	if instance == nil {
+		if err := inv.refreshInstances(inventoryMissRefresh); err != nil {
+			return nil, fmt.Errorf("cloudInstance: %w", err)
+		}
+		instance = inv.findCloudInstance(instanceID, hostname)
+	}
+	if instance == nil {
+		return nil, cloudprovider.InstanceNotFound
+	}
+	return instance, nil
+}
+
+func (inv *inventory) findCloudInstance(instanceID, hostname string) *utho.CloudInstance {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return findCloudInstance(inv.instances, instanceID, hostname)
+}
+
+func findCloudInstance(instances []utho.CloudInstance, instanceID, hostname string) *utho.CloudInstance {
+	for idx := range instances {
+		if instanceID != "" && instances[idx].ID == instanceID {
+			return &instances[idx]
+		}
+		if instanceID == "" && hostname != "" && instances[idx].Hostname == hostname {
+			return &instances[idx]
+		}
+	}
+	return nil
+}
+
+// refresh reads the cluster again unless the cached copy is younger than
+// maxAge, such as after a concurrent lookup refreshed it. There is no cluster in
+// unmanaged mode. The cache stays readable while the API is read.
+func (inv *inventory) refresh(maxAge time.Duration) error {
+	if unmanagedMode() || fresh(&inv.mu, &inv.fetched, maxAge) {
+		return nil
+	}
+	inv.refreshMu.Lock()
+	defer inv.refreshMu.Unlock()
+	if fresh(&inv.mu, &inv.fetched, maxAge) {
+		return nil
+	}
+
+	clusterID, err := inv.clusterID()
+	if err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	cluster, err := inv.client.Kubernetes().Read(clusterID)
+	if err != nil {
+		return fmt.Errorf("refresh: failed to read cluster %s: %w", clusterID, err)
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.cluster = cluster
+	inv.fetched = time.Now()
+	return nil
+}
+
+// refreshInstances lists the cloud instances again unless the cached list is
+// younger than maxAge.
+func (inv *inventory) refreshInstances(maxAge time.Duration) error {
+	if fresh(&inv.mu, &inv.instancesFetched, maxAge) {
+		return nil
+	}
+	inv.refreshMu.Lock()
+	defer inv.refreshMu.Unlock()
+	if fresh(&inv.mu, &inv.instancesFetched, maxAge) {
+		return nil
+	}
+
+	instances, err := inv.client.CloudInstances().List()
+	if err != nil {
+		return fmt.Errorf("refreshInstances: failed to list cloud instances: %w", err)
+	}
+	if instances == nil {
+		instances = []utho.CloudInstance{}
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.instances = instances
+	inv.instancesFetched = time.Now()
+	return nil
+}
+
+// fresh returns whether something was fetched, at the time guarded by mu, less
+// than maxAge ago.
+func fresh(mu *sync.Mutex, fetched *time.Time, maxAge time.Duration) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return !fetched.IsZero() && time.Since(*fetched) < maxAge
+}
@@ -1,6 +1,20 @@
 package utho
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
 const (
+	// annoUthoPrefix is the common prefix of every Utho load balancer annotation.
+	annoUthoPrefix = "service.beta.kubernetes.io/utho-loadbalancer-"
+
 	// annoUthoLoadBalancerName is used to set custom labels for load balancers.
 	// This allows users to define a specific name for the Utho load balancer.
 	annoUthoLoadBalancerName = "service.beta.kubernetes.io/utho-loadbalancer-name"
@@ -10,7 +24,8 @@ const (
 	annoUthoLoadBalancerID = "service.beta.kubernetes.io/utho-loadbalancer-id"
 
 	// annoUthoAlgorithm defines the load balancing algorithm for the load balancer.
-	// Accepted values: "roundrobin" or "leastconn".
+	// Accepted values: "roundrobin", "leastconn" or "source".
+	// Defaults to "source" for services with sessionAffinity ClientIP, "roundrobin" otherwise.
 	annoUthoAlgorithm = "service.beta.kubernetes.io/utho-loadbalancer-algorithm"
 
 	// annoUthoStickySessionEnabled determines whether sticky sessions are enabled for the load balancer.
@@ -28,4 +43,417 @@ const (
 	// annoUthoNetworkType defines the network type for the load balancer.
 	// Accepted values: "private" or "public" (defaults to "public" if not specified).
 	annoUthoNetworkType = "service.beta.kubernetes.io/utho-loadbalancer-network-type"
+
+	// annoUthoClientTimeout would set how long an idle client connection is kept open by the frontends.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoClientTimeout = "service.beta.kubernetes.io/utho-loadbalancer-client-timeout"
+
+	// annoUthoServerTimeout would set how long an idle connection to a backend is kept open.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoServerTimeout = "service.beta.kubernetes.io/utho-loadbalancer-server-timeout"
+
+	// annoUthoConnectTimeout would set how long the load balancer waits for a backend connection.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoConnectTimeout = "service.beta.kubernetes.io/utho-loadbalancer-connect-timeout"
+
+	// annoUthoProtocol overrides the frontend protocol otherwise derived from the ports' appProtocol.
+	// Accepted values: "tcp", "http" or "https" for all ports, or a list of port:protocol pairs ("80:http,443:https").
+	annoUthoProtocol = "service.beta.kubernetes.io/utho-loadbalancer-protocol"
+
+	// annoUthoBackendMode selects what the backends of the load balancer are: whole node pools,
+	// or the individual instances of the nodes the service controller passes, so that nodes it
+	// excludes are removed one by one. Accepted values: "nodepool" or "instance" (defaults to "nodepool").
+	// Unmanaged clusters always use instance backends.
+	annoUthoBackendMode = "service.beta.kubernetes.io/utho-loadbalancer-backend-mode"
+
+	// annoUthoNodePools restricts the backends of the load balancer to the listed node pools,
+	// or instances in instance backend mode.
+	// Accepted values: a comma separated list of node pool or instance IDs ("12345,12346").
+	annoUthoNodePools = "service.beta.kubernetes.io/utho-loadbalancer-node-pools"
+
+	// annoUthoNodeSelector restricts the backends of the load balancer to the node pools with
+	// at least one node matching the label selector, e.g. "node-role/edge=true".
+	annoUthoNodeSelector = "service.beta.kubernetes.io/utho-loadbalancer-node-selector"
+
+	// annoUthoBackendWeights would set the weight of the backends on each node pool.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoBackendWeights = "service.beta.kubernetes.io/utho-loadbalancer-backend-weights"
+
+	// annoUthoDrainTimeout would set how long backends that are removed from the load balancer keep
+	// serving their open connections, without getting new ones, before they are deleted.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoDrainTimeout = "service.beta.kubernetes.io/utho-loadbalancer-drain-timeout"
+
+	// annoUthoVPC sets the VPC the load balancer is created in, instead of the VPC of the cluster.
+	// Changing it requires recreating the load balancer, see annoUthoAllowRecreate.
+	annoUthoVPC = "service.beta.kubernetes.io/utho-loadbalancer-vpc"
+
+	// annoUthoAllowRecreate allows the CCM to replace the load balancer when a setting that cannot be
+	// changed in place (type, network type or VPC) changes. The service gets a new IP address.
+	// Accepted values: "true" or "false" (defaults to "false").
+	annoUthoAllowRecreate = "service.beta.kubernetes.io/utho-loadbalancer-allow-recreate"
+
+	// annoUthoImmutableSettings records the settings the load balancer was created with.
+	// This annotation is managed automatically by the CCM and should not be manually modified.
+	annoUthoImmutableSettings = "service.beta.kubernetes.io/utho-loadbalancer-immutable-settings"
+
+	// annoUthoPendingDelete holds the ID of a replaced load balancer, deleted once the service
+	// status points at its replacement. This annotation is managed automatically by the CCM.
+	annoUthoPendingDelete = "service.beta.kubernetes.io/utho-loadbalancer-pending-delete"
+
+	// annoUthoMaxConnections would limit the number of concurrent connections accepted by each frontend.
+	// Not supported, see unsupportedAnnotations.
+	annoUthoMaxConnections = "service.beta.kubernetes.io/utho-loadbalancer-max-connections"
+)
+
+const (
+	algorithmRoundRobin = "roundrobin"
+	algorithmLeastConn  = "leastconn"
+	algorithmSource     = "source"
+
+	protoTCP   = "tcp"
+	protoHTTP  = "http"
+	protoHTTPS = "https"
+
+	networkTypePublic  = "public"
+	networkTypePrivate = "private"
+
+	backendModeNodePool = "nodepool"
+	backendModeInstance = "instance"
 )
+
+// knownAnnotations lists every annotation understood by lbConfig.
+var knownAnnotations = map[string]struct{}{
+	annoUthoLoadBalancerName:     {},
+	annoUthoLoadBalancerID:       {},
+	annoUthoAlgorithm:            {},
+	annoUthoStickySessionEnabled: {},
+	annoUthoRedirectHTTPToHTTPS:  {},
+	annoUthoLBSSLID:              {},
+	annoUthoNetworkType:          {},
+	annoUthoClientTimeout:        {},
+	annoUthoServerTimeout:        {},
+	annoUthoConnectTimeout:       {},
+	annoUthoMaxConnections:       {},
+	annoUthoProtocol:             {},
+	annoUthoVPC:                  {},
+	annoUthoBackendMode:          {},
+	annoUthoNodePools:            {},
+	annoUthoNodeSelector:         {},
+	annoUthoBackendWeights:       {},
+	annoUthoDrainTimeout:         {},
+	annoUthoAllowRecreate:        {},
+	annoUthoImmutableSettings:    {},
+	annoUthoPendingDelete:        {},
+}
+
+// ccmManagedAnnotations are written by the CCM only.
+var ccmManagedAnnotations = []string{
+	annoUthoLoadBalancerID,
+	annoUthoImmutableSettings,
+	annoUthoPendingDelete,
+}
+
+// lbConfig is the typed form of the Utho annotations set on a Service.
+type lbConfig struct {
+	Name                string
+	ID                  string
+	Type                string
+	Algorithm           string
+	StickySession       bool
+	RedirectHTTPToHTTPS bool
+	SSLID               string
+	NetworkType         string
+	VPC                 string
+	AllowRecreate       bool
+
+	// BackendMode is backendModeNodePool or backendModeInstance.
+	BackendMode string
+
+	// NodePools and NodeSelector restrict the node pools used as backends, nil if unset.
+	NodePools    []string
+	NodeSelector labels.Selector
+
+	// Protocol is the frontend protocol forced for all ports, and PortProtocols
+	// the ones forced per port. Both are empty unless annoUthoProtocol is set.
+	Protocol      string
+	PortProtocols map[int32]string
+}
+
+// unsupportedAnnotations are the annotations of settings the Utho load balancer
+// API has no documented field for. They are rejected rather than sent under
+// guessed names, which the API could ignore without an error. Backend weights
+// and draining, which needs a way to stop new connections to a backend, are not
+// documented either.
+var unsupportedAnnotations = []string{
+	annoUthoClientTimeout,
+	annoUthoServerTimeout,
+	annoUthoConnectTimeout,
+	annoUthoMaxConnections,
+	annoUthoDrainTimeout,
+	annoUthoBackendWeights,
+}
+
+// parseLBConfig parses the Utho annotations of a service, applying the defaults
+// of its load balancer class for the ones that are not set. Unknown or malformed
+// values are reported as errors rather than silently replaced by their default.
+func parseLBConfig(service *v1.Service) (*lbConfig, error) {
+	class, ok := serviceLBClass(service)
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s has load balancer class %q, which is not handled by the CCM",
+			service.Namespace, service.Name, *service.Spec.LoadBalancerClass)
+	}
+
+	cfg := &lbConfig{
+		Type:        class.Type,
+		Algorithm:   algorithmRoundRobin,
+		NetworkType: networkTypePublic,
+		BackendMode: backendModeNodePool,
+	}
+
+	var errs []error
+	annotations := classAnnotations(class, service)
+
+	cfg.Name = annotations[annoUthoLoadBalancerName]
+	cfg.ID = annotations[annoUthoLoadBalancerID]
+	cfg.SSLID = annotations[annoUthoLBSSLID]
+	cfg.VPC = strings.TrimSpace(annotations[annoUthoVPC])
+
+	// ClientIP affinity maps onto source based stickiness unless an algorithm is
+	// set explicitly. Its timeout has no Utho setting and is not applied.
+	if service.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+		cfg.Algorithm = algorithmSource
+	}
+
+	for _, key := range unsupportedAnnotations {
+		if _, ok := annotations[key]; ok {
+			errs = append(errs, fmt.Errorf("%s is not supported: the Utho load balancer API has no documented setting for it", key))
+		}
+	}
+
+	if v, ok := annotations[annoUthoAlgorithm]; ok {
+		switch algo := strings.ToLower(strings.TrimSpace(v)); algo {
+		case algorithmRoundRobin, algorithmLeastConn, algorithmSource:
+			cfg.Algorithm = algo
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown algorithm %q (expected %q, %q or %q)",
+				annoUthoAlgorithm, v, algorithmRoundRobin, algorithmLeastConn, algorithmSource))
+		}
+	}
+
+	if v, ok := annotations[annoUthoStickySessionEnabled]; ok {
+		b, err := parseBoolAnnotation(annoUthoStickySessionEnabled, v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cfg.StickySession = b
+	}
+
+	if v, ok := annotations[annoUthoRedirectHTTPToHTTPS]; ok {
+		b, err := parseBoolAnnotation(annoUthoRedirectHTTPToHTTPS, v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cfg.RedirectHTTPToHTTPS = b
+	}
+
+	if v, ok := annotations[annoUthoBackendMode]; ok {
+		switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+		case backendModeNodePool, backendModeInstance:
+			cfg.BackendMode = mode
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown backend mode %q (expected %q or %q)",
+				annoUthoBackendMode, v, backendModeNodePool, backendModeInstance))
+		}
+	}
+
+	if v, ok := annotations[annoUthoNodePools]; ok {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				cfg.NodePools = append(cfg.NodePools, id)
+			}
+		}
+		if len(cfg.NodePools) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no node pool ID in %q", annoUthoNodePools, v))
+		}
+	}
+
+	if v, ok := annotations[annoUthoNodeSelector]; ok {
+		selector, err := labels.Parse(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid label selector %q: %w", annoUthoNodeSelector, v, err))
+		} else if selector.Empty() {
+			errs = append(errs, fmt.Errorf("%s: empty label selector", annoUthoNodeSelector))
+		}
+		cfg.NodeSelector = selector
+	}
+
+	if v, ok := annotations[annoUthoAllowRecreate]; ok {
+		b, err := parseBoolAnnotation(annoUthoAllowRecreate, v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cfg.AllowRecreate = b
+	}
+
+	if v, ok := annotations[annoUthoNetworkType]; ok {
+		switch nt := strings.ToLower(strings.TrimSpace(v)); nt {
+		case networkTypePublic, networkTypePrivate:
+			cfg.NetworkType = nt
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown network type %q (expected %q or %q)",
+				annoUthoNetworkType, v, networkTypePublic, networkTypePrivate))
+		}
+	}
+
+	if v, ok := annotations[annoUthoProtocol]; ok {
+		if err := cfg.parseProtocols(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid annotations on service %s/%s: %w",
+			service.Namespace, service.Name, utilerrors.NewAggregate(errs))
+	}
+	return cfg, nil
+}
+
+// parseBoolAnnotation accepts "true"/"false" as documented, as well as the
+// legacy "1"/"0" values.
+func parseBoolAnnotation(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean %q (expected \"true\" or \"false\")", key, value)
+	}
+	return b, nil
+}
+
+// parseProtocols parses annoUthoProtocol, either a single protocol for all
+// ports or a list of port:protocol pairs.
+func (c *lbConfig) parseProtocols(value string) error {
+	parseProto := func(v string) (string, error) {
+		switch proto := strings.ToLower(strings.TrimSpace(v)); proto {
+		case protoTCP, protoHTTP, protoHTTPS:
+			return proto, nil
+		default:
+			return "", fmt.Errorf("%s: unknown protocol %q (expected %q, %q or %q)",
+				annoUthoProtocol, v, protoTCP, protoHTTP, protoHTTPS)
+		}
+	}
+
+	if !strings.Contains(value, ":") {
+		proto, err := parseProto(value)
+		c.Protocol = proto
+		return err
+	}
+
+	c.PortProtocols = make(map[int32]string)
+	for _, pair := range strings.Split(value, ",") {
+		port, proto, _ := strings.Cut(pair, ":")
+		n, err := strconv.ParseInt(strings.TrimSpace(port), 10, 32)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s: invalid port %q in %q", annoUthoProtocol, port, value)
+		}
+		p, err := parseProto(proto)
+		if err != nil {
+			return err
+		}
+		c.PortProtocols[int32(n)] = p
+	}
+	return nil
+}
+
+// unknownAnnotations returns the utho-loadbalancer-* annotations on a service
+// that lbConfig does not understand, usually typos of a known key.
+func unknownAnnotations(service *v1.Service) []string {
+	var unknown []string
+	for key := range service.Annotations {
+		if !strings.HasPrefix(key, annoUthoPrefix) {
+			continue
+		}
+		if _, ok := knownAnnotations[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// cookie returns the frontend cookie flag for the sticky session setting.
+func (c *lbConfig) cookie() string {
+	if c.StickySession {
+		return "1"
+	}
+	return "0"
+}
+
+// immutableSettings returns the settings that cannot be changed on an existing
+// load balancer, in the format of annoUthoImmutableSettings.
+func (c *lbConfig) immutableSettings() string {
+	return fmt.Sprintf("type=%s,network-type=%s,vpc=%s", c.Type, c.NetworkType, c.VPC)
+}
+
+// enablePublicIP returns the enable_publicip value for the network type.
+func (c *lbConfig) enablePublicIP() string {
+	if c.NetworkType == networkTypePrivate {
+		return "false"
+	}
+	return "true"
+}
+
+// conflicts reports annotation combinations that parse on their own but cannot
+// be applied to the ports of the service. Ports a Utho load balancer does not
+// forward, such as UDP ones, are only warnings: they still work inside the
+// cluster, and mixed-protocol services are common.
+func (c *lbConfig) conflicts(service *v1.Service) ([]error, []string) {
+	var errs []error
+	var warnings []string
+
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != v1.ProtocolTCP {
+			warnings = append(warnings, fmt.Sprintf("port %d: %s is not forwarded by the load balancer, only TCP ports are", port.Port, port.Protocol))
+		}
+	}
+
+	for _, port := range service.Spec.Ports {
+		if c.frontendProto(port) == protoHTTPS && c.SSLID == "" {
+			errs = append(errs, fmt.Errorf("port %d is terminated as https but %s is not set", port.Port, annoUthoLBSSLID))
+		}
+	}
+
+	if !c.hasTLSPort(service) {
+		if c.SSLID != "" {
+			errs = append(errs, fmt.Errorf("%s is set but the service has no TLS port (%s)", annoUthoLBSSLID, tlsPortHint))
+		}
+		if c.RedirectHTTPToHTTPS {
+			errs = append(errs, fmt.Errorf("%s is enabled but the service has no TLS port (%s)", annoUthoRedirectHTTPToHTTPS, tlsPortHint))
+		}
+	}
+
+	return errs, warnings
+}
+
+// tlsPortHint describes the ports hasTLSPort recognizes, for error messages.
+const tlsPortHint = "443, 8443, a port named https or tls, or appProtocol https"
+
+// hasTLSPort returns whether the service exposes a port that serves TLS: port
+// 443 or 8443, a port named https or tls (or https-*, tls-*, following the
+// Istio naming convention), or one whose protocol resolves to https.
+func (c *lbConfig) hasTLSPort(service *v1.Service) bool {
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		if port.Port == 443 || port.Port == 8443 || isTLSAppProtocol(port.AppProtocol) || c.frontendProto(port) == protoHTTPS {
+			return true
+		}
+		name := strings.ToLower(port.Name)
+		for _, prefix := range []string{"https", "tls"} {
+			if name == prefix || strings.HasPrefix(name, prefix+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
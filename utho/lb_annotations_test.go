@@ -0,0 +1,28 @@
+package utho
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseLBConfigUnsupported(t *testing.T) {
+	for _, key := range unsupportedAnnotations {
+		t.Run(key, func(t *testing.T) {
+			service := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "web",
+					Annotations: map[string]string{key: "60"},
+				},
+				Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+			}
+			_, err := parseLBConfig(service)
+			if err == nil || !strings.Contains(err.Error(), key+" is not supported") {
+				t.Errorf("parseLBConfig() error = %v, want %s rejected as unsupported", err, key)
+			}
+		})
+	}
+}
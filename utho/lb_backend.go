@@ -0,0 +1,86 @@
+package utho
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// backendRequest is the body of the backend create call:
+// utho.CreateLoadbalancerBackendParams with the backend protocol. It is sent
+// with the client directly rather than through the SDK, so that createBackend
+// can read the load balancer before each attempt.
+type backendRequest struct {
+	Type        string `json:"type"`
+	FrontendID  string `json:"frontend_id"`
+	BackendPort string `json:"backend_port"`
+	Cloudid     string `json:"cloudid,omitempty"`
+	PoolName    string `json:"pool_name,omitempty"`
+	Proto       string `json:"proto,omitempty"`
+}
+
+// createBackend creates a backend on the load balancer, retrying while the
+// load balancer is still being installed. The load balancer is read before each
+// attempt: a backend on the node port that appeared since the first attempt was
+// created by an attempt that did not report success, and is not created twice.
+func (l *loadbalancers) createBackend(lbID string, be backendRequest) (*utho.CreateResponse, error) {
+	const (
+		maxRetries    = 5
+		sleepDuration = 45 * time.Second
+	)
+
+	var before sets.Set[string]
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			time.Sleep(sleepDuration)
+		}
+
+		lb, err := l.readLB(lbID)
+		if err != nil {
+			return nil, fmt.Errorf("createBackend: %w", err)
+		}
+		current := sets.New[string]()
+		for _, fe := range lb.Frontends {
+			if fe.ID != be.FrontendID {
+				continue
+			}
+			for _, backend := range fe.Backends {
+				if backend.BackendPort == be.BackendPort {
+					current.Insert(backend.ID)
+				}
+			}
+		}
+		if before == nil {
+			before = current
+		} else if created := sets.List(current.Difference(before)); len(created) > 0 {
+			return &utho.CreateResponse{ID: created[0], Status: "success"}, nil
+		}
+		if !lb.installed() {
+			klog.Infof("createBackend: attempt %d/%d - load balancer %s status: %s", i+1, maxRetries, lbID, lb.AppStatus)
+			continue
+		}
+
+		req, err := l.client.NewRequest("POST", "loadbalancer/"+lbID+"/backend", &be)
+		if err != nil {
+			return nil, fmt.Errorf("createBackend: %w", err)
+		}
+
+		var res utho.CreateResponse
+		if _, err := l.client.Do(req, &res); err != nil {
+			return nil, fmt.Errorf("createBackend: %w", err)
+		}
+		if strings.EqualFold(res.Status, "error") {
+			return nil, fmt.Errorf("createBackend: %s", res.Message)
+		}
+		if strings.EqualFold(res.AppStatus, string(utho.Installed)) || strings.EqualFold(res.Status, "success") {
+			return &res, nil
+		}
+		klog.Infof("createBackend: attempt %d/%d - load balancer %s status: %s", i+1, maxRetries, lbID, res.AppStatus)
+	}
+
+	return nil, fmt.Errorf("createBackend: load balancer %s was not installed after %d retries", lbID, maxRetries)
+}
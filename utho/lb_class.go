@@ -0,0 +1,122 @@
+package utho
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// loadBalancerClassNetwork is the spec.loadBalancerClass of Services exposed
+	// through a Utho network (layer 4) load balancer.
+	loadBalancerClassNetwork = "utho.com/network"
+
+	// loadBalancerClassApplication is the spec.loadBalancerClass of Services
+	// exposed through a Utho application (layer 7) load balancer.
+	loadBalancerClassApplication = "utho.com/application"
+
+	lbTypeNetwork     = "network"
+	lbTypeApplication = "application"
+)
+
+// lbClass holds the settings shared by every Service of a load balancer class.
+type lbClass struct {
+	// Type is the Utho load balancer type, "network" or "application".
+	Type string `json:"type"`
+	// Annotations are utho-loadbalancer-* defaults, overridden by the ones set on the Service.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// lbClassFile is the format of the file passed with --utho-load-balancer-classes.
+type lbClassFile struct {
+	Classes map[string]lbClass `json:"classes"`
+}
+
+// lbClasses are the load balancer classes handled by the CCM. Services naming
+// any other class are left to the load balancer implementation owning it.
+var lbClasses = map[string]lbClass{
+	loadBalancerClassNetwork:     {Type: lbTypeNetwork},
+	loadBalancerClassApplication: {Type: lbTypeApplication},
+}
+
+// loadLBClasses adds the classes of a class file to lbClasses. Classes with the
+// name of a built-in class replace it.
+func loadLBClasses(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("loadLBClasses: %w", err)
+	}
+
+	file := &lbClassFile{}
+	if err := yaml.UnmarshalStrict(data, file); err != nil {
+		return fmt.Errorf("loadLBClasses: failed to parse %s: %w", path, err)
+	}
+
+	for name, class := range file.Classes {
+		if err := class.validate(); err != nil {
+			return fmt.Errorf("loadLBClasses: class %q: %w", name, err)
+		}
+		lbClasses[name] = class
+	}
+	return nil
+}
+
+func (c lbClass) validate() error {
+	switch c.Type {
+	case lbTypeNetwork, lbTypeApplication:
+	default:
+		return fmt.Errorf("unknown type %q (expected %q or %q)", c.Type, lbTypeNetwork, lbTypeApplication)
+	}
+
+	for key := range c.Annotations {
+		if _, ok := knownAnnotations[key]; !ok || !strings.HasPrefix(key, annoUthoPrefix) {
+			return fmt.Errorf("unknown annotation %q", key)
+		}
+		if key == annoUthoLoadBalancerName || key == annoUthoAllowRecreate || containsString(ccmManagedAnnotations, key) {
+			return fmt.Errorf("annotation %q cannot have a class default", key)
+		}
+	}
+	return nil
+}
+
+// serviceLBClass returns the class of a service and whether the CCM handles it.
+// Services without a class are handled with the defaults of the network class.
+func serviceLBClass(service *v1.Service) (lbClass, bool) {
+	if service.Spec.LoadBalancerClass == nil {
+		return lbClasses[loadBalancerClassNetwork], true
+	}
+	class, ok := lbClasses[*service.Spec.LoadBalancerClass]
+	return class, ok
+}
+
+// isUthoLBClass returns whether a service names one of the classes in lbClasses.
+func isUthoLBClass(service *v1.Service) bool {
+	if service.Spec.LoadBalancerClass == nil {
+		return false
+	}
+	_, ok := lbClasses[*service.Spec.LoadBalancerClass]
+	return ok
+}
+
+// classAnnotations merges the defaults of the cloud config and of a class with
+// the annotations of a service, the latter taking precedence.
+func classAnnotations(class lbClass, service *v1.Service) map[string]string {
+	if len(lbDefaults) == 0 && len(class.Annotations) == 0 {
+		return service.Annotations
+	}
+
+	annotations := make(map[string]string, len(lbDefaults)+len(class.Annotations)+len(service.Annotations))
+	for k, v := range lbDefaults {
+		annotations[k] = v
+	}
+	for k, v := range class.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range service.Annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
@@ -0,0 +1,281 @@
+package utho
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LBClassControllerName is the name of the controller handling Services with
+	// a Utho spec.loadBalancerClass in --controllers.
+	LBClassControllerName = "utho-lb-class"
+
+	// lbClassFinalizer makes sure the load balancer of a classed Service is
+	// deleted with it. The service controller uses its own finalizer, which it
+	// does not add to Services with a load balancer class.
+	lbClassFinalizer = "utho.com/load-balancer-cleanup"
+
+	lbClassWorkers = 2
+)
+
+// lbClassController provisions load balancers for Services naming one of the
+// classes in lbClasses. The service controller of the cloud-provider library
+// skips every Service with a load balancer class, so the CCM runs its own loop
+// for those.
+type lbClassController struct {
+	lbs         *loadbalancers
+	clusterName string
+	kubeClient  kubernetes.Interface
+	lister      corelisters.ServiceLister
+	queue       workqueue.TypedRateLimitingInterface[string]
+}
+
+// StartLBClassController starts the load balancer class controller in the
+// background until ctx is done. The informers are started by the caller.
+func StartLBClassController(ctx context.Context, cloudProvider cloudprovider.Interface, clusterName string, kubeClient kubernetes.Interface, informer coreinformers.ServiceInformer, nodeInformer coreinformers.NodeInformer) error {
+	c, ok := cloudProvider.(*cloud)
+	if !ok {
+		return fmt.Errorf("StartLBClassController: unexpected cloud provider %T", cloudProvider)
+	}
+
+	lc := &lbClassController{
+		lbs:         c.loadbalancers.(*loadbalancers),
+		clusterName: clusterName,
+		kubeClient:  kubeClient,
+		lister:      informer.Lister(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: LBClassControllerName},
+		),
+	}
+
+	if _, err := informer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			service, ok := obj.(*v1.Service)
+			// services that left the class keep the finalizer until cleaned up
+			return ok && (isUthoLBClass(service) || containsString(service.Finalizers, lbClassFinalizer))
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: lc.enqueue,
+			UpdateFunc: func(old, obj interface{}) {
+				// skip the status updates, such as the ones of sync itself
+				if serviceChanged(old.(*v1.Service), obj.(*v1.Service)) {
+					lc.enqueue(obj)
+				}
+			},
+			DeleteFunc: lc.enqueue,
+		},
+	}); err != nil {
+		return fmt.Errorf("StartLBClassController: %w", err)
+	}
+
+	// the backends follow the nodes, as with the service controller
+	if _, err := nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { lc.enqueueAll() },
+		UpdateFunc: func(old, obj interface{}) {
+			if nodeChanged(old.(*v1.Node), obj.(*v1.Node)) {
+				lc.enqueueAll()
+			}
+		},
+		DeleteFunc: func(interface{}) { lc.enqueueAll() },
+	}); err != nil {
+		return fmt.Errorf("StartLBClassController: %w", err)
+	}
+
+	go func() {
+		defer utilruntime.HandleCrash()
+		defer lc.queue.ShutDown()
+
+		if !cache.WaitForNamedCacheSync(LBClassControllerName, ctx.Done(), informer.Informer().HasSynced, nodeInformer.Informer().HasSynced) {
+			return
+		}
+		for i := 0; i < lbClassWorkers; i++ {
+			go wait.UntilWithContext(ctx, lc.worker, time.Second)
+		}
+		<-ctx.Done()
+	}()
+
+	return nil
+}
+
+func (lc *lbClassController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	lc.queue.Add(key)
+}
+
+// enqueueAll enqueues every Service with a Utho load balancer class.
+func (lc *lbClassController) enqueueAll() {
+	services, err := lc.lister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, service := range services {
+		if isUthoLBClass(service) {
+			lc.enqueue(service)
+		}
+	}
+}
+
+// serviceChanged reports whether an update of a Service changed more than its
+// status, which does not affect its load balancer. The spec itself is compared,
+// rather than relying on the generation of the Service.
+func serviceChanged(old, service *v1.Service) bool {
+	return !apiequality.Semantic.DeepEqual(old.Spec, service.Spec) ||
+		!apiequality.Semantic.DeepEqual(old.Annotations, service.Annotations) ||
+		!apiequality.Semantic.DeepEqual(old.Labels, service.Labels) ||
+		!apiequality.Semantic.DeepEqual(old.Finalizers, service.Finalizers) ||
+		!old.DeletionTimestamp.Equal(service.DeletionTimestamp)
+}
+
+// nodeChanged reports whether an update of a node can change the backends of
+// the load balancers: its eligibility, labels, used by node selectors, or
+// provider ID.
+func nodeChanged(old, node *v1.Node) bool {
+	return nodeEligible(old) != nodeEligible(node) ||
+		old.Spec.ProviderID != node.Spec.ProviderID ||
+		!apiequality.Semantic.DeepEqual(old.Labels, node.Labels)
+}
+
+func (lc *lbClassController) worker(ctx context.Context) {
+	for lc.processNextItem(ctx) {
+	}
+}
+
+func (lc *lbClassController) processNextItem(ctx context.Context) bool {
+	key, quit := lc.queue.Get()
+	if quit {
+		return false
+	}
+	defer lc.queue.Done(key)
+
+	if err := lc.sync(ctx, key); err != nil {
+		klog.Errorf("lbClassController: failed to sync service %q: %v", key, err)
+		lc.queue.AddRateLimited(key)
+		return true
+	}
+	lc.queue.Forget(key)
+	return true
+}
+
+// sync creates, updates or deletes the load balancer of a single Service. The
+// finalizer tells whether the Service has a load balancer to delete: changing
+// the type of a Service also clears its class, so a Service that is deleted, no
+// longer of type LoadBalancer or no longer of a Utho class is cleaned up if it
+// still has the finalizer.
+func (lc *lbClassController) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	cached, err := lc.lister.Services(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	service := cached.DeepCopy()
+
+	if service.DeletionTimestamp != nil || service.Spec.Type != v1.ServiceTypeLoadBalancer || !isUthoLBClass(service) {
+		if !containsString(service.Finalizers, lbClassFinalizer) {
+			return nil
+		}
+		if err := lc.lbs.EnsureLoadBalancerDeleted(ctx, lc.clusterName, service); err != nil {
+			return fmt.Errorf("sync: %w", err)
+		}
+		if err := lc.patchIngress(ctx, service, nil); err != nil {
+			return fmt.Errorf("sync: failed to clear load balancer status: %w", err)
+		}
+		_, err := lc.patchFinalizers(ctx, service, removeString(service.Finalizers, lbClassFinalizer))
+		return err
+	}
+
+	if !containsString(service.Finalizers, lbClassFinalizer) {
+		// continue with the patched service, the load balancer code may update it
+		service, err = lc.patchFinalizers(ctx, service, append(service.Finalizers, lbClassFinalizer))
+		if err != nil {
+			return fmt.Errorf("sync: failed to add finalizer: %w", err)
+		}
+	}
+
+	// the service controller skips classed services, so their nodes are picked here
+	nodes, err := eligibleNodes()
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	status, err := lc.lbs.EnsureLoadBalancer(ctx, lc.clusterName, service, nodes)
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	if !apiequality.Semantic.DeepEqual(&service.Status.LoadBalancer, status) {
+		if err := lc.patchIngress(ctx, service, status.Ingress); err != nil {
+			return fmt.Errorf("sync: failed to update load balancer status: %w", err)
+		}
+	}
+	return nil
+}
+
+func (lc *lbClassController) patchFinalizers(ctx context.Context, service *v1.Service, finalizers []string) (*v1.Service, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": service.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lc.kubeClient.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+// patchIngress replaces the load balancer ingress of a service, removing it if ingress is nil.
+func (lc *lbClassController) patchIngress(ctx context.Context, service *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{"ingress": ingress},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = lc.kubeClient.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+func removeString(list []string, s string) []string {
+	var result []string
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
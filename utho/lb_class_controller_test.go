@@ -0,0 +1,85 @@
+package utho
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLBClassControllerTypeChange(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			_, _ = w.Write([]byte(`{"status":"success","loadbalancers":[{"id":"lb-1","ip":"203.0.113.10"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	apiURL := Options.APIURL
+	Options.APIURL = server.URL + "/"
+	defer func() { Options.APIURL = apiURL }()
+
+	client, err := newSharedClient("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the class is cleared along with the type
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web",
+			Annotations: map[string]string{annoUthoLoadBalancerID: "lb-1"},
+			Finalizers:  []string{lbClassFinalizer},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}},
+		},
+	}
+	kubeClient := fake.NewSimpleClientset(service)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(service); err != nil {
+		t.Fatal(err)
+	}
+
+	lc := &lbClassController{
+		lbs:         &loadbalancers{client: client, kubeClient: kubeClient, locks: &serviceLocks{}},
+		clusterName: "kubernetes",
+		kubeClient:  kubeClient,
+		lister:      corelisters.NewServiceLister(indexer),
+	}
+	if err := lc.sync(context.Background(), "default/web"); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+
+	deleted := false
+	for _, req := range requests {
+		deleted = deleted || req == "DELETE /loadbalancer/lb-1"
+	}
+	if !deleted {
+		t.Errorf("sync() sent %q, want the load balancer deleted", requests)
+	}
+
+	got, err := kubeClient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if containsString(got.Finalizers, lbClassFinalizer) {
+		t.Errorf("finalizer %s was not removed", lbClassFinalizer)
+	}
+	if len(got.Status.LoadBalancer.Ingress) != 0 {
+		t.Errorf("load balancer ingress = %v, want none", got.Status.LoadBalancer.Ingress)
+	}
+}
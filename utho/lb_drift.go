@@ -0,0 +1,389 @@
+package utho
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+// DriftControllerName is the name of the load balancer drift check in --controllers.
+const DriftControllerName = "utho-lb-drift"
+
+var (
+	driftGauge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      "utho",
+		Subsystem:      "load_balancer",
+		Name:           "drift_items",
+		Help:           "Number of differences between a Utho load balancer and the desired state of its service, as of the last drift check.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace", "service"})
+
+	driftCorrections = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      "utho",
+		Subsystem:      "load_balancer",
+		Name:           "drift_corrections_total",
+		Help:           "Number of load balancer drift corrections, by result.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"result"})
+)
+
+func init() {
+	legacyregistry.MustRegister(driftGauge, driftCorrections)
+}
+
+// driftItem is a difference between a load balancer and the desired state of its service.
+type driftItem struct {
+	description string
+	// correct reverts the difference. It is nil for frontend differences, which
+	// are reverted together by syncLoadBalancer.
+	correct func() error
+	// lbMissing is set on the only difference reported for a load balancer that
+	// no longer exists, which is left to the service controller to recreate.
+	lbMissing bool
+}
+
+// driftController periodically compares the load balancers of Services with
+// their desired state, catching changes made through the Utho dashboard or API.
+type driftController struct {
+	lbs         *loadbalancers
+	lister      corelisters.ServiceLister
+	autoCorrect bool
+
+	// reported holds the services with a drift gauge, to drop the gauge of deleted ones.
+	reported sets.Set[string]
+}
+
+// StartDriftController starts the drift check in the background until ctx is
+// done. It returns false if the check is disabled.
+func StartDriftController(ctx context.Context, cloudProvider cloudprovider.Interface, informer coreinformers.ServiceInformer) (bool, error) {
+	if Options.DriftCheckInterval <= 0 {
+		return false, nil
+	}
+
+	c, ok := cloudProvider.(*cloud)
+	if !ok {
+		return false, fmt.Errorf("StartDriftController: unexpected cloud provider %T", cloudProvider)
+	}
+
+	dc := &driftController{
+		lbs:         c.loadbalancers.(*loadbalancers),
+		lister:      informer.Lister(),
+		autoCorrect: Options.DriftAutoCorrect,
+		reported:    sets.New[string](),
+	}
+	hasSynced := informer.Informer().HasSynced
+
+	go func() {
+		if !cache.WaitForNamedCacheSync(DriftControllerName, ctx.Done(), hasSynced) {
+			return
+		}
+		wait.JitterUntilWithContext(ctx, dc.checkAll, Options.DriftCheckInterval, 0.1, true)
+	}()
+
+	return true, nil
+}
+
+// checkAll runs the drift check for every Service with a Utho load balancer.
+func (dc *driftController) checkAll(ctx context.Context) {
+	services, err := dc.lister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("driftController: failed to list services: %v", err)
+		return
+	}
+
+	seen := sets.New[string]()
+	for _, service := range services {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer || service.DeletionTimestamp != nil {
+			continue
+		}
+		if _, handled := serviceLBClass(service); !handled || service.Annotations[annoUthoLoadBalancerID] == "" {
+			continue
+		}
+
+		key := service.Namespace + "/" + service.Name
+		seen.Insert(key)
+		dc.check(ctx, service.DeepCopy())
+	}
+
+	for key := range dc.reported.Difference(seen) {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		driftGauge.DeleteLabelValues(namespace, name)
+	}
+	dc.reported = seen
+}
+
+// check compares the load balancer of a single service with its desired state,
+// and reverts the differences if auto-correction is enabled.
+func (dc *driftController) check(ctx context.Context, service *v1.Service) {
+	items, err := dc.lbs.detectDrift(ctx, service)
+	if err != nil {
+		klog.Warningf("driftController: failed to check service %s/%s: %v", service.Namespace, service.Name, err)
+		return
+	}
+	driftGauge.WithLabelValues(service.Namespace, service.Name).Set(float64(len(items)))
+	if len(items) == 0 {
+		return
+	}
+
+	descriptions := make([]string, 0, len(items))
+	for _, item := range items {
+		descriptions = append(descriptions, item.description)
+	}
+	klog.Warningf("driftController: load balancer of service %s/%s drifted: %s", service.Namespace, service.Name, strings.Join(descriptions, "; "))
+	dc.lbs.recordEvent(service, v1.EventTypeWarning, eventReasonDriftDetected,
+		"Utho load balancer differs from the desired state: %s", strings.Join(descriptions, "; "))
+
+	if !dc.autoCorrect {
+		return
+	}
+
+	// the service controller may have updated the service in the meantime
+	latest, err := dc.lister.Services(service.Namespace).Get(service.Name)
+	if err != nil {
+		klog.Warningf("driftController: failed to get service %s/%s: %v", service.Namespace, service.Name, err)
+		return
+	}
+	corrected, err := dc.lbs.correctDrift(ctx, latest.DeepCopy())
+	if err != nil {
+		driftCorrections.WithLabelValues("error").Inc()
+		klog.Errorf("driftController: failed to correct drift of service %s/%s: %v", service.Namespace, service.Name, err)
+		return
+	}
+	if corrected == 0 {
+		return
+	}
+	driftCorrections.WithLabelValues("success").Inc()
+	dc.lbs.recordEvent(service, v1.EventTypeNormal, eventReasonDriftCorrected,
+		"Reverted %d change(s) made to the Utho load balancer outside of the CCM", corrected)
+}
+
+// detectDrift lists the differences between the load balancer of a service and
+// the frontends, backends and routing the CCM would configure for it. ACLs and
+// routes are never set up by the CCM, so any of them is reported. It only reads:
+// the load balancer is looked up by the ID annotation alone, and one that no
+// longer exists is reported rather than forgotten.
+func (l *loadbalancers) detectDrift(ctx context.Context, service *v1.Service) ([]driftItem, error) {
+	cfg, err := parseLBConfig(service)
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: %w", err)
+	}
+
+	lbID := service.Annotations[annoUthoLoadBalancerID]
+	if lbID == "" {
+		return nil, nil
+	}
+	lb, err := l.client.Loadbalancers().Read(lbID)
+	if err != nil && isNotFound(err) {
+		return []driftItem{{description: fmt.Sprintf("load balancer %s no longer exists", lbID), lbMissing: true}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: failed to read load balancer %s: %w", lbID, err)
+	}
+
+	frontends, err := l.listFrontends(lb.ID)
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: %w", err)
+	}
+	nodes, err := eligibleNodes()
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: %w", err)
+	}
+	clusterId, nodePoolId, err := l.clusterBackendInfo(service, cfg, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: %w", err)
+	}
+	pools, err := allBackendPools(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("detectDrift: %w", err)
+	}
+	owners := l.backendOwners(cfg, pools)
+
+	current := make(map[string]lbFrontend, len(frontends))
+	for _, fe := range frontends {
+		current[fe.Port] = fe
+	}
+
+	var items []driftItem
+	desiredPorts := sets.New[string]()
+
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		portStr := strconv.Itoa(int(port.Port))
+		desiredPorts.Insert(portStr)
+
+		fe, ok := current[portStr]
+		if !ok {
+			items = append(items, driftItem{description: fmt.Sprintf("frontend for port %s is missing", portStr)})
+			continue
+		}
+
+		if changes := frontendChanges(fe, desiredFrontend(cfg, port)); len(changes) > 0 {
+			items = append(items, driftItem{
+				description: fmt.Sprintf("frontend for port %s has %s", portStr, strings.Join(changes, ", ")),
+			})
+		}
+
+		items = append(items, l.backendDrift(lb.ID, service, cfg, port, fe, nodePoolId, clusterId, owners)...)
+
+		for _, route := range fe.Routes {
+			route := route
+			items = append(items, driftItem{
+				description: fmt.Sprintf("frontend for port %s has unmanaged route %s", portStr, route.ID),
+				correct: func() error {
+					_, err := l.client.Loadbalancers().DeleteRoute(lb.ID, route.ID)
+					return err
+				},
+			})
+		}
+		for _, acl := range fe.Acls {
+			acl := acl
+			items = append(items, driftItem{
+				description: fmt.Sprintf("frontend for port %s has unmanaged ACL %q", portStr, acl.Name),
+				correct: func() error {
+					_, err := l.client.Loadbalancers().DeleteACL(lb.ID, acl.ID)
+					return err
+				},
+			})
+		}
+	}
+
+	for portStr := range current {
+		if !desiredPorts.Has(portStr) {
+			items = append(items, driftItem{description: fmt.Sprintf("unexpected frontend for port %s", portStr)})
+		}
+	}
+
+	return items, nil
+}
+
+// backendDrift compares the backends of a frontend with the node pools, or
+// instances, selected for the service, the node port of its service port and
+// its backend protocol.
+func (l *loadbalancers) backendDrift(lbID string, service *v1.Service, cfg *lbConfig, port v1.ServicePort, fe lbFrontend, nodePoolId []string, clusterId string, owners map[string]string) []driftItem {
+	var items []driftItem
+	nodePort := strconv.Itoa(int(port.NodePort))
+	proto := cfg.backendProto(port)
+	target := "node pool"
+	if cfg.instanceBackends() {
+		target = "instance"
+	}
+
+	selected := sets.New(nodePoolId...)
+	covered := sets.New[string]()
+	for _, backend := range fe.Backends {
+		owner := backendOwner(cfg, owners, backend)
+		if selected.Has(owner) && backend.BackendPort == nodePort && backendProtoMatches(backend, proto) {
+			covered.Insert(owner)
+			continue
+		}
+
+		var description string
+		switch {
+		case backend.BackendPort != nodePort:
+			description = fmt.Sprintf("backend %s of port %d forwards to port %s instead of node port %s", backend.IP, port.Port, backend.BackendPort, nodePort)
+		case !backendProtoMatches(backend, proto):
+			description = fmt.Sprintf("backend %s of port %d speaks %s instead of %s", backend.IP, port.Port, backend.Proto, proto)
+		case owner == "":
+			description = fmt.Sprintf("backend %s of port %d is not a node of the cluster", backend.IP, port.Port)
+		default:
+			description = fmt.Sprintf("backend %s of port %d is on %s %s, which is not selected", backend.IP, port.Port, target, owner)
+		}
+		backend := backend
+		items = append(items, driftItem{
+			description: description,
+			correct: func() error {
+				_, err := l.client.Loadbalancers().DeleteBackend(lbID, backend.ID)
+				return err
+			},
+		})
+	}
+
+	if missing := sets.List(selected.Difference(covered)); len(missing) > 0 {
+		items = append(items, driftItem{
+			description: fmt.Sprintf("frontend for port %d has no backend on %s %s", port.Port, target, strings.Join(missing, ", ")),
+			correct: func() error {
+				return l.createBackends(lbID, fe.ID, service, port, missing, clusterId)
+			},
+		})
+	}
+
+	return items
+}
+
+// correctDrift reverts the differences between the load balancer of a service
+// and its desired state, and returns how many there were. They are detected
+// again under the lock of the service, as the service controller may have
+// changed the load balancer since the check. Frontend differences are reverted
+// by syncLoadBalancer, which also brings the backends of the frontends up to
+// date, the remaining ones one by one.
+func (l *loadbalancers) correctDrift(ctx context.Context, service *v1.Service) (int, error) {
+	unlock := l.locks.lock(service.Namespace, service.Name)
+	defer unlock()
+
+	items, err := l.detectDrift(ctx, service)
+	if err != nil {
+		return 0, fmt.Errorf("correctDrift: %w", err)
+	}
+	if len(items) == 1 && items[0].lbMissing {
+		klog.Warningf("correctDrift: %s, leaving service %s/%s to the service controller", items[0].description, service.Namespace, service.Name)
+		return 0, nil
+	}
+	corrected := len(items)
+
+	needsSync := false
+	for _, item := range items {
+		if item.correct == nil {
+			needsSync = true
+		}
+	}
+
+	if needsSync {
+		cfg, err := parseLBConfig(service)
+		if err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+		lb, err := l.client.Loadbalancers().Read(service.Annotations[annoUthoLoadBalancerID])
+		if err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+		nodes, err := eligibleNodes()
+		if err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+		clusterId, nodePoolId, err := l.clusterBackendInfo(service, cfg, nodes)
+		if err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+		if err := l.syncLoadBalancer(lb, service, cfg, nodePoolId, clusterId); err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+		if items, err = l.detectDrift(ctx, service); err != nil {
+			return 0, fmt.Errorf("correctDrift: %w", err)
+		}
+	}
+
+	for _, item := range items {
+		if item.correct == nil {
+			continue
+		}
+		if err := item.correct(); err != nil {
+			return 0, fmt.Errorf("correctDrift: %s: %w", item.description, err)
+		}
+	}
+	return corrected, nil
+}
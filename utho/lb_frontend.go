@@ -0,0 +1,276 @@
+package utho
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// frontendRequest is the body of the frontend create call, the fields of
+// utho.CreateLoadbalancerFrontendParams. It is sent with a raw request, so that
+// the load balancer can be read before each attempt, see createFrontend.
+type frontendRequest struct {
+	Name          string `json:"name"`
+	Proto         string `json:"proto"`
+	Port          string `json:"port"`
+	CertificateID string `json:"certificate_id,omitempty"`
+	Algorithm     string `json:"algorithm"`
+	Redirecthttps string `json:"redirecthttps,omitempty"`
+	Cookie        string `json:"cookie"`
+}
+
+// lbFrontend is a frontend as returned by the load balancer API, including its
+// backends, which the SDK does not decode.
+type lbFrontend struct {
+	utho.Frontends
+
+	Backends []frontendBackend `json:"backends"`
+}
+
+// frontendBackend is a backend as listed under its frontend.
+type frontendBackend struct {
+	ID          string `json:"id"`
+	IP          string `json:"ip"`
+	Cloudid     string `json:"cloudid"`
+	Status      string `json:"status"`
+	BackendPort string `json:"backend_port"`
+	Proto       string `json:"proto"`
+}
+
+// appProtocol values of Service ports that select the frontend and backend protocols.
+const (
+	appProtocolHTTP   = "http"
+	appProtocolHTTPS  = "https"
+	appProtocolH2C    = "h2c"
+	appProtocolWS     = "kubernetes.io/ws"
+	appProtocolWSS    = "kubernetes.io/wss"
+	appProtocolK8sH2C = "kubernetes.io/h2c"
+)
+
+// frontendProto resolves the frontend protocol of a port. The protocol
+// annotation takes precedence over the appProtocol of the port, which in turn
+// takes precedence over the legacy rule terminating TLS on ports 80 and 443
+// whenever an SSL certificate is set.
+func (c *lbConfig) frontendProto(port v1.ServicePort) string {
+	if proto, ok := c.PortProtocols[port.Port]; ok {
+		return proto
+	}
+	if c.Protocol != "" {
+		return c.Protocol
+	}
+
+	if port.AppProtocol != nil {
+		switch strings.ToLower(*port.AppProtocol) {
+		case appProtocolHTTP, appProtocolWS:
+			return protoHTTP
+		case appProtocolHTTPS, appProtocolWSS:
+			// without a certificate TLS is passed through to the backends
+			if c.SSLID != "" {
+				return protoHTTPS
+			}
+			return protoTCP
+		case appProtocolH2C, appProtocolK8sH2C:
+			// HTTP/2 without TLS is passed through untouched
+			return protoTCP
+		}
+	}
+
+	if (port.Port == 80 || port.Port == 443) && c.SSLID != "" {
+		return protoHTTPS
+	}
+	return protoTCP
+}
+
+// isTLSAppProtocol returns whether the appProtocol of a port is TLS based.
+func isTLSAppProtocol(appProtocol *string) bool {
+	if appProtocol == nil {
+		return false
+	}
+	p := strings.ToLower(*appProtocol)
+	return p == appProtocolHTTPS || p == appProtocolWSS
+}
+
+// backendProto resolves the protocol the load balancer speaks to the backends of
+// a port: the one of the frontend, except that TLS is set up again towards
+// backends whose appProtocol is TLS based, and never towards other backends.
+// Passed through TCP stays TCP.
+func (c *lbConfig) backendProto(port v1.ServicePort) string {
+	switch proto := c.frontendProto(port); {
+	case proto == protoTCP:
+		return protoTCP
+	case isTLSAppProtocol(port.AppProtocol):
+		return protoHTTPS
+	default:
+		return protoHTTP
+	}
+}
+
+// desiredFrontend builds the frontend settings for a service port.
+func desiredFrontend(cfg *lbConfig, port v1.ServicePort) frontendRequest {
+	fe := frontendRequest{
+		Proto:     cfg.frontendProto(port),
+		Port:      strconv.Itoa(int(port.Port)),
+		Algorithm: cfg.Algorithm,
+		Cookie:    cfg.cookie(),
+	}
+
+	// Add `Redirecthttps` only for HTTP ports and `CertificateID` only where TLS is terminated
+	if cfg.RedirectHTTPToHTTPS && (port.Port == 80 || port.Port == 443 || fe.Proto != protoTCP) {
+		fe.Redirecthttps = "1"
+	}
+	if fe.Proto == protoHTTPS {
+		fe.CertificateID = cfg.SSLID
+	}
+
+	return fe
+}
+
+// frontendChanges lists the settings of an existing frontend that differ from
+// the desired ones.
+func frontendChanges(current lbFrontend, desired frontendRequest) []string {
+	var changes []string
+
+	compare := func(name, have, want string) {
+		if !strings.EqualFold(have, want) {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", name, have, want))
+		}
+	}
+
+	compare("proto", current.Proto, desired.Proto)
+	compare("algorithm", current.Algorithm, desired.Algorithm)
+	compare("cookie", flagOrZero(current.Cookie), flagOrZero(desired.Cookie))
+	compare("redirecthttps", flagOrZero(current.Redirecthttps), flagOrZero(desired.Redirecthttps))
+	compare("certificate_id", current.CertificateID, desired.CertificateID)
+
+	return changes
+}
+
+// flagOrZero normalises an unset "0"/"1" API flag to "0".
+func flagOrZero(v string) string {
+	if v == "" {
+		return "0"
+	}
+	return v
+}
+
+// createFrontend creates a frontend on the load balancer, retrying while the
+// load balancer is still being installed. The load balancer is read before each
+// attempt, so that a frontend created by an attempt that did not report success
+// is not created twice.
+func (l *loadbalancers) createFrontend(lbID string, fe frontendRequest) (*utho.CreateResponse, error) {
+	const (
+		maxRetries    = 5
+		sleepDuration = 45 * time.Second
+	)
+
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			time.Sleep(sleepDuration)
+		}
+
+		lb, err := l.readLB(lbID)
+		if err != nil {
+			return nil, fmt.Errorf("createFrontend: %w", err)
+		}
+		for _, existing := range lb.Frontends {
+			if existing.Port == fe.Port {
+				return &utho.CreateResponse{ID: existing.ID, Status: "success"}, nil
+			}
+		}
+		if !lb.installed() {
+			klog.Infof("createFrontend: attempt %d/%d - load balancer %s status: %s", i+1, maxRetries, lbID, lb.AppStatus)
+			continue
+		}
+
+		req, err := l.client.NewRequest("POST", "loadbalancer/"+lbID+"/frontend", &fe)
+		if err != nil {
+			return nil, fmt.Errorf("createFrontend: %w", err)
+		}
+
+		var res utho.CreateResponse
+		if _, err := l.client.Do(req, &res); err != nil {
+			return nil, fmt.Errorf("createFrontend: %w", err)
+		}
+		if strings.EqualFold(res.Status, "error") {
+			return nil, fmt.Errorf("createFrontend: %s", res.Message)
+		}
+		if strings.EqualFold(res.AppStatus, string(utho.Installed)) || strings.EqualFold(res.Status, "success") {
+			return &res, nil
+		}
+		klog.Infof("createFrontend: attempt %d/%d - load balancer %s status: %s", i+1, maxRetries, lbID, res.AppStatus)
+	}
+
+	return nil, fmt.Errorf("createFrontend: load balancer %s was not installed after %d retries", lbID, maxRetries)
+}
+
+// updateFrontend replaces the settings of an existing frontend.
+func (l *loadbalancers) updateFrontend(lbID, frontendID string, fe frontendRequest) error {
+	params := utho.UpdateLoadbalancerFrontendParams{
+		LoadbalancerId: lbID,
+		Name:           fe.Name,
+		Proto:          fe.Proto,
+		Port:           fe.Port,
+		CertificateID:  fe.CertificateID,
+		Algorithm:      fe.Algorithm,
+		Redirecthttps:  fe.Redirecthttps,
+		Cookie:         fe.Cookie,
+	}
+	res, err := l.client.Loadbalancers().UpdateFrontend(params, lbID, frontendID)
+	if err != nil {
+		return fmt.Errorf("updateFrontend: %w", err)
+	}
+	if res.Status != "success" && res.Status != "" {
+		return fmt.Errorf("updateFrontend: %s", res.Message)
+	}
+	return nil
+}
+
+// lbDetails is a load balancer as returned by the API, with the backends of its
+// frontends, which the SDK does not decode.
+type lbDetails struct {
+	AppStatus string       `json:"app_status"`
+	Frontends []lbFrontend `json:"frontends"`
+}
+
+// installed returns whether the load balancer accepts new frontends and backends.
+func (d *lbDetails) installed() bool {
+	return strings.EqualFold(d.AppStatus, string(utho.Installed))
+}
+
+// readLB reads a load balancer with the backends of its frontends.
+func (l *loadbalancers) readLB(lbID string) (*lbDetails, error) {
+	req, err := l.client.NewRequest("GET", "loadbalancer/"+lbID)
+	if err != nil {
+		return nil, fmt.Errorf("readLB: %w", err)
+	}
+
+	var res struct {
+		Loadbalancers []lbDetails `json:"loadbalancers"`
+		Status        string      `json:"status"`
+		Message       string      `json:"message"`
+	}
+	if _, err := l.client.Do(req, &res); err != nil {
+		return nil, fmt.Errorf("readLB: %w", err)
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, fmt.Errorf("readLB: %s", res.Message)
+	}
+	if len(res.Loadbalancers) == 0 {
+		return nil, fmt.Errorf("readLB: %w", errLbNotFound)
+	}
+	return &res.Loadbalancers[0], nil
+}
+
+// listFrontends returns the frontends of a load balancer with all their settings.
+func (l *loadbalancers) listFrontends(lbID string) ([]lbFrontend, error) {
+	lb, err := l.readLB(lbID)
+	if err != nil {
+		return nil, fmt.Errorf("listFrontends: %w", err)
+	}
+	return lb.Frontends, nil
+}
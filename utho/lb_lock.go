@@ -0,0 +1,47 @@
+package utho
+
+import "sync"
+
+// serviceLocks serializes the changes made to the load balancer of a service by
+// the service controller, the LB class controller, the drift check and the
+// migration waits, which would otherwise act on the same frontends and backends
+// at once.
+type serviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*serviceLock
+}
+
+type serviceLock struct {
+	sync.Mutex
+	// users is the number of callers holding or waiting for the lock.
+	users int
+}
+
+// lock locks the load balancer of the service namespace/name, and returns the
+// function unlocking it.
+func (s *serviceLocks) lock(namespace, name string) func() {
+	key := namespace + "/" + name
+
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*serviceLock)
+	}
+	lk, ok := s.locks[key]
+	if !ok {
+		lk = &serviceLock{}
+		s.locks[key] = lk
+	}
+	lk.users++
+	s.mu.Unlock()
+
+	lk.Lock()
+	return func() {
+		lk.Unlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if lk.users--; lk.users == 0 {
+			delete(s.locks, key)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package utho
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// migrationPollInterval is how often the CCM checks whether the status of a
+// service points at its replacement load balancer.
+const migrationPollInterval = 10 * time.Second
+
+// migrationWaits holds the cancel function of the pending migration wait of
+// each service, by namespace/name.
+var migrationWaits = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+// migratedLBName returns the name of the load balancer replacing the one of a
+// service, derived from its name and the immutable settings of the replacement,
+// so that it differs from the name of the load balancer it replaces.
+func migratedLBName(lbName, settings string) string {
+	h := fnv.New32a()
+	h.Write([]byte(settings))
+	return fmt.Sprintf("%s-%08x", lbName, h.Sum32())
+}
+
+// recordImmutableSettings stores the settings a load balancer was created with
+// on its service, so that later changes to them can be detected.
+func (l *loadbalancers) recordImmutableSettings(ctx context.Context, service *v1.Service) error {
+	cfg, err := parseLBConfig(service)
+	if err != nil {
+		return fmt.Errorf("recordImmutableSettings: %w", err)
+	}
+	settings := cfg.immutableSettings()
+	if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoImmutableSettings: &settings}); err != nil {
+		return fmt.Errorf("recordImmutableSettings: %w", err)
+	}
+	return nil
+}
+
+// migrateIfNeeded replaces the load balancer of a service if a setting that
+// cannot be changed in place differs from the one it was created with, and the
+// service allows it. The replacement is fully configured before the service is
+// switched to it, and the old load balancer is only deleted once the service
+// status shows the new address. It returns whether the load balancer was replaced.
+func (l *loadbalancers) migrateIfNeeded(ctx context.Context, service *v1.Service, cfg *lbConfig, lb *utho.Loadbalancer, nodes []*v1.Node) (bool, error) {
+	want := cfg.immutableSettings()
+	have, ok := service.Annotations[annoUthoImmutableSettings]
+	if !ok {
+		// created before the settings were recorded, assume they match
+		if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoImmutableSettings: &want}); err != nil {
+			return false, fmt.Errorf("migrateIfNeeded: %w", err)
+		}
+		return false, nil
+	}
+	if have == want {
+		return false, nil
+	}
+
+	if pending := service.Annotations[annoUthoPendingDelete]; pending != "" {
+		klog.Infof("migrateIfNeeded: service %s/%s is still switching away from load balancer %s", service.Namespace, service.Name, pending)
+		return false, nil
+	}
+	if !cfg.AllowRecreate {
+		klog.Warningf("migrateIfNeeded: service %s/%s changed immutable settings %q -> %q", service.Namespace, service.Name, have, want)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonImmutableChanged,
+			"Changing %q to %q requires recreating the load balancer, set %s to \"true\" to allow it", have, want, annoUthoAllowRecreate)
+		return false, nil
+	}
+
+	if err := l.GetKubeClient(); err != nil {
+		return false, fmt.Errorf("migrateIfNeeded: failed to get kubeclient: %w", err)
+	}
+	vpcId, err := l.inventory.vpcID()
+	if err != nil {
+		return false, fmt.Errorf("migrateIfNeeded: failed to get VPC ID: %w", err)
+	}
+	clusterId, nodePoolId, err := l.clusterBackendInfo(service, cfg, nodes)
+	if err != nil {
+		return false, fmt.Errorf("migrateIfNeeded: %w", err)
+	}
+
+	klog.Infof("migrateIfNeeded: replacing load balancer %s of service %s/%s: %q -> %q", lb.ID, service.Namespace, service.Name, have, want)
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonRecreatingLB, "Replacing load balancer %s: %q -> %q", lb.ID, have, want)
+
+	name := migratedLBName(l.GetLoadBalancerName(ctx, "", service), want)
+	created, err := l.CreateUthoLoadBalancer(name, vpcId, service, nodePoolId, clusterId)
+	if err != nil {
+		return false, fmt.Errorf("migrateIfNeeded: failed to create replacement load balancer: %w", err)
+	}
+
+	if err := l.patchServiceAnnotations(ctx, service, map[string]*string{
+		annoUthoLoadBalancerID:    &created.ID,
+		annoUthoImmutableSettings: &want,
+		annoUthoPendingDelete:     &lb.ID,
+	}); err != nil {
+		return false, fmt.Errorf("migrateIfNeeded: failed to switch service to load balancer %s: %w", created.ID, err)
+	}
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonCreatedLB, "Created replacement load balancer %s, %s is deleted once the service status is updated", created.ID, lb.ID)
+
+	l.waitForMigration(service.Namespace, service.Name)
+	return true, nil
+}
+
+// finishMigration deletes the load balancer replaced by migrateIfNeeded once the
+// service status points at its replacement.
+func (l *loadbalancers) finishMigration(ctx context.Context, service *v1.Service) (bool, error) {
+	oldID := service.Annotations[annoUthoPendingDelete]
+	if oldID == "" {
+		return true, nil
+	}
+
+	lb, err := l.client.Loadbalancers().Read(service.Annotations[annoUthoLoadBalancerID])
+	if err != nil {
+		return false, fmt.Errorf("finishMigration: %w", err)
+	}
+	switched := false
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP == lb.IP {
+			switched = true
+		}
+	}
+	if !switched {
+		return false, nil
+	}
+
+	if _, err := l.client.Loadbalancers().Delete(oldID); err != nil && !isNotFound(err) {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to delete replaced load balancer %s: %v", oldID, err)
+		return false, fmt.Errorf("finishMigration: failed to delete load balancer %s: %w", oldID, err)
+	}
+	klog.Infof("finishMigration: deleted load balancer %s replaced by %s", oldID, lb.ID)
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonDeletedLB, "Deleted replaced load balancer %s", oldID)
+
+	if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoPendingDelete: nil}); err != nil {
+		return false, fmt.Errorf("finishMigration: %w", err)
+	}
+	return true, nil
+}
+
+// waitForMigration polls a service in the background until its status points
+// at the replacement load balancer, then deletes the old one. The service
+// controller does not reconcile a service for its own status update, so this
+// would otherwise wait for the next change to the service. There is at most one
+// wait per service; it holds the lock of the service while checking it, and
+// ends when the CCM stops or the service is deleted. The pending deletion is
+// kept in annoUthoPendingDelete, so that the next reconciliation of the service
+// after a restart waits again.
+func (l *loadbalancers) waitForMigration(namespace, name string) {
+	key := namespace + "/" + name
+
+	migrationWaits.Lock()
+	defer migrationWaits.Unlock()
+	if _, waiting := migrationWaits.cancels[key]; waiting {
+		return
+	}
+	ctx, cancel := context.WithCancel(wait.ContextForChannel(l.stop))
+	migrationWaits.cancels[key] = cancel
+
+	go func() {
+		defer func() {
+			migrationWaits.Lock()
+			delete(migrationWaits.cancels, key)
+			migrationWaits.Unlock()
+			cancel()
+		}()
+
+		err := wait.PollUntilContextCancel(ctx, migrationPollInterval, false, func(ctx context.Context) (bool, error) {
+			unlock := l.locks.lock(namespace, name)
+			defer unlock()
+
+			service, err := l.kubeClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			if err != nil {
+				klog.Warningf("waitForMigration: failed to get service %s/%s: %v", namespace, name, err)
+				return false, nil
+			}
+			if service.DeletionTimestamp != nil {
+				// EnsureLoadBalancerDeleted deletes both load balancers
+				return true, nil
+			}
+			done, err := l.finishMigration(ctx, service)
+			if err != nil {
+				klog.Warningf("waitForMigration: %v", err)
+				return false, nil
+			}
+			return done, nil
+		})
+		if err != nil {
+			klog.V(2).Infof("waitForMigration: stopped waiting for service %s/%s to switch to its new load balancer: %v", namespace, name, err)
+		}
+	}()
+}
+
+// stopMigration stops the migration wait of a service, whose load balancer is deleted.
+func stopMigration(namespace, name string) {
+	key := namespace + "/" + name
+
+	migrationWaits.Lock()
+	defer migrationWaits.Unlock()
+	if cancel, ok := migrationWaits.cancels[key]; ok {
+		cancel()
+		delete(migrationWaits.cancels, key)
+	}
+}
@@ -0,0 +1,237 @@
+package utho
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// instanceBackends reports whether the backends of the load balancer are the
+// instances of the nodes rather than whole node pools.
+func (c *lbConfig) instanceBackends() bool {
+	return c.BackendMode == backendModeInstance || unmanagedMode()
+}
+
+// toBeDeletedTaint is the taint of the nodes the cluster autoscaler is removing.
+const toBeDeletedTaint = "ToBeDeletedByClusterAutoscaler"
+
+// backendPools groups the nodes matching selector by backend: node pool, or
+// instance with instance backends. Instance backends are limited to nodes, the
+// ones the service controller considers eligible; callers that do not get them
+// from the service controller, such as gateways, pass nil to use eligibleNodes.
+func backendPools(cfg *lbConfig, selector labels.Selector, nodes []*v1.Node) (map[string][]v1.Node, error) {
+	if !cfg.instanceBackends() {
+		return GetNodePools(selector)
+	}
+
+	if nodes == nil {
+		var err error
+		if nodes, err = eligibleNodes(); err != nil {
+			return nil, fmt.Errorf("backendPools: %w", err)
+		}
+	}
+	eligible := make([]v1.Node, 0, len(nodes))
+	for _, node := range nodes {
+		eligible = append(eligible, *node)
+	}
+	return groupNodes(eligible, selector, true), nil
+}
+
+// eligibleNodes returns the nodes the service controller passes to
+// EnsureLoadBalancer and UpdateLoadBalancer, with the same predicates, for the
+// load balancers it does not reconcile itself.
+func eligibleNodes() ([]*v1.Node, error) {
+	nodes, err := listNodes()
+	if err != nil {
+		return nil, fmt.Errorf("eligibleNodes: %w", err)
+	}
+
+	var eligible []*v1.Node
+	for idx := range nodes {
+		if nodeEligible(&nodes[idx]) {
+			eligible = append(eligible, &nodes[idx])
+		}
+	}
+	return eligible, nil
+}
+
+// nodeEligible reports whether a node is neither being deleted, nor excluded
+// from load balancers, nor being removed by the cluster autoscaler.
+func nodeEligible(node *v1.Node) bool {
+	if !node.DeletionTimestamp.IsZero() {
+		return false
+	}
+	if _, excluded := node.Labels[v1.LabelNodeExcludeBalancers]; excluded {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == toBeDeletedTaint {
+			return false
+		}
+	}
+	return true
+}
+
+// allBackendPools groups every node of the cluster by backend, eligible or not,
+// so that the backends of nodes that are no longer eligible can be found.
+func allBackendPools(cfg *lbConfig) (map[string][]v1.Node, error) {
+	nodes, err := listNodes()
+	if err != nil {
+		return nil, fmt.Errorf("allBackendPools: %w", err)
+	}
+	return groupNodes(nodes, labels.Everything(), cfg.instanceBackends()), nil
+}
+
+// selectNodePools returns the IDs of the node pools, or instances, used as
+// backends of a service, restricted by annoUthoNodePools and
+// annoUthoNodeSelector. It fails if no node pool is left, rather than leaving
+// the load balancer without backends.
+func (l *loadbalancers) selectNodePools(service *v1.Service, cfg *lbConfig, nodes []*v1.Node) ([]string, error) {
+	selector := cfg.NodeSelector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+
+	pools, err := backendPools(cfg, selector, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("selectNodePools: %w", err)
+	}
+
+	var ids []string
+	for id := range pools {
+		if len(cfg.NodePools) == 0 || containsString(cfg.NodePools, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	if len(ids) == 0 {
+		err := fmt.Errorf("no node pool matches %s and %s on service %s/%s", annoUthoNodePools, annoUthoNodeSelector, service.Namespace, service.Name)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonNoNodePools, "%v", err)
+		return nil, fmt.Errorf("selectNodePools: %w", err)
+	}
+	return ids, nil
+}
+
+// syncBackends makes the backends of an existing frontend match the selected
+// node pools or instances, their protocol and the node port of the
+// service port. Backends are matched to node pools or instances through backendOwner; any
+// other backend, such as the one of a deleted node, is removed.
+func (l *loadbalancers) syncBackends(lbID string, service *v1.Service, cfg *lbConfig, port v1.ServicePort, fe lbFrontend, nodePoolId []string, clusterId string) error {
+	pools, err := allBackendPools(cfg)
+	if err != nil {
+		return fmt.Errorf("syncBackends: %w", err)
+	}
+	owners := l.backendOwners(cfg, pools)
+
+	selected := sets.New(nodePoolId...)
+	nodePort := strconv.Itoa(int(port.NodePort))
+	proto := cfg.backendProto(port)
+	covered := sets.New[string]()
+	var stale []frontendBackend
+
+	for _, backend := range fe.Backends {
+		pool := backendOwner(cfg, owners, backend)
+		if selected.Has(pool) && backend.BackendPort == nodePort && backendProtoMatches(backend, proto) {
+			covered.Insert(pool)
+			continue
+		}
+		stale = append(stale, backend)
+	}
+
+	if missing := sets.List(selected.Difference(covered)); len(missing) > 0 {
+		if err := l.createBackends(lbID, fe.ID, service, port, missing, clusterId); err != nil {
+			return fmt.Errorf("syncBackends: %w", err)
+		}
+	}
+
+	for _, backend := range stale {
+		if _, err := l.client.Loadbalancers().DeleteBackend(lbID, backend.ID); err != nil && !isNotFound(err) {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to delete backend %s on port %d: %v", backend.IP, port.Port, err)
+			return fmt.Errorf("syncBackends: error deleting backend %s: %w", backend.ID, err)
+		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonBackendDeleted, "Deleted backend %s on node port %s", backend.IP, backend.BackendPort)
+	}
+
+	return nil
+}
+
+// backendProtoMatches reports whether a backend speaks proto. A backend the API
+// lists without a protocol is assumed to.
+func backendProtoMatches(backend frontendBackend, proto string) bool {
+	return backend.Proto == "" || strings.EqualFold(backend.Proto, proto)
+}
+
+// backendOwners maps the addresses of the nodes of the cluster, and of the
+// workers of its node pools, to their node pool, or instance with instance
+// backends, so that backends can be matched to what they were created for.
+func (l *loadbalancers) backendOwners(cfg *lbConfig, pools map[string][]v1.Node) map[string]string {
+	owners := make(map[string]string)
+	if !unmanagedMode() {
+		if cluster, err := l.inventory.getCluster(); err != nil {
+			klog.Warningf("backendOwners: matching backends with nodes only: %v", err)
+		} else {
+			for key, pool := range cluster.Nodepools {
+				poolID := pool.Id
+				if poolID == "" {
+					poolID = key
+				}
+				for _, w := range pool.Workers {
+					owner := poolID
+					if cfg.instanceBackends() {
+						owner = w.ID
+					}
+					for _, ip := range []string{w.Ip, w.PrivateNetwork.Ip} {
+						if ip != "" {
+							owners[ip] = owner
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for id, nodes := range pools {
+		for _, node := range nodes {
+			for _, addr := range node.Status.Addresses {
+				if addr.Type == v1.NodeInternalIP || addr.Type == v1.NodeExternalIP {
+					owners[addr.Address] = id
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// backendOwner returns the node pool or instance a backend was created for, or
+// "" if it is not one of the cluster.
+func backendOwner(cfg *lbConfig, owners map[string]string, backend frontendBackend) string {
+	if cfg.instanceBackends() && backend.Cloudid != "" {
+		return backend.Cloudid
+	}
+	return owners[backend.IP]
+}
+
+// clusterBackendInfo returns the cluster ID and the IDs of the node pools, or
+// instances, the backends of a service are created for. nodes is passed on to
+// backendPools.
+func (l *loadbalancers) clusterBackendInfo(service *v1.Service, cfg *lbConfig, nodes []*v1.Node) (string, []string, error) {
+	if err := l.GetKubeClient(); err != nil {
+		return "", nil, fmt.Errorf("clusterBackendInfo: failed to get kubeclient: %w", err)
+	}
+	clusterId, err := l.inventory.clusterID()
+	if err != nil {
+		return "", nil, fmt.Errorf("clusterBackendInfo: failed to get cluster ID: %w", err)
+	}
+	nodePoolId, err := l.selectNodePools(service, cfg, nodes)
+	if err != nil {
+		return "", nil, fmt.Errorf("clusterBackendInfo: %w", err)
+	}
+	return clusterId, nodePoolId, nil
+}
@@ -2,7 +2,10 @@ package utho
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -10,9 +13,12 @@ import (
 	"github.com/uthoplatforms/utho-go/utho"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 )
@@ -21,17 +27,26 @@ var errLbNotFound = fmt.Errorf("loadbalancer not found")
 var _ cloudprovider.LoadBalancer = &loadbalancers{}
 
 type loadbalancers struct {
-	client utho.Client
-	zone   string
+	client    utho.Client
+	inventory *inventory
 
 	kubeClient kubernetes.Interface
+	recorder   record.EventRecorder
+
+	locks *serviceLocks
+	// stop is closed when the CCM stops, ending the background work started by
+	// reconciliations.
+	stop <-chan struct{}
 }
 
-func newLoadbalancers(client utho.Client, zone string) cloudprovider.LoadBalancer {
-	return &loadbalancers{client: client, zone: zone}
+func newLoadbalancers(client utho.Client, inv *inventory) cloudprovider.LoadBalancer {
+	return &loadbalancers{client: client, inventory: inv, locks: &serviceLocks{}}
 }
 
 func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	unlock := l.locks.lock(service.Namespace, service.Name)
+	defer unlock()
+
 	_, exists, err := l.GetLoadBalancer(ctx, clusterName, service)
 	if err != nil {
 		return nil, fmt.Errorf("EnsureLoadBalancer: %w", err)
@@ -47,56 +62,50 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 		}
 
 		// Get cluster ID
-		clusterId, err := GetLabelValue(l.kubeClient, "cluster_id")
+		clusterId, err := l.inventory.clusterID()
 		if err != nil {
 			return nil, fmt.Errorf("EnsureLoadBalancer: failed to get cluster ID: %w", err)
 		}
 
 		// Get VPC ID
-		vpcId, err := GetLabelValue(l.kubeClient, "cluster_vpc")
+		vpcId, err := l.inventory.vpcID()
 		if err != nil {
 			return nil, fmt.Errorf("EnsureLoadBalancer: failed to get VPC ID: %w", err)
 		}
 
 		// Get nodepool ID
-		nodePoolId, err := GetNodePoolsID()
+		cfg, err := parseLBConfig(service)
 		if err != nil {
-			return nil, fmt.Errorf("EnsureLoadBalancer: failed to get nodepool ID: %w", err)
+			return nil, fmt.Errorf("EnsureLoadBalancer: %w", err)
+		}
+		nodePoolId, err := l.selectNodePools(service, cfg, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("EnsureLoadBalancer: %w", err)
 		}
 
 		lbName := l.GetLoadBalancerName(ctx, "", service)
 
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonCreatingLB, "Creating Utho load balancer %q", lbName)
 		lb, err := l.CreateUthoLoadBalancer(lbName, vpcId, service, nodePoolId, clusterId)
 		if err != nil {
 			return nil, fmt.Errorf("EnsureLoadBalancer: failed to create load-balancer: %w", err)
 		}
 		klog.Infof("EnsureLoadBalancer: Created load balancer %q", lb.ID)
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonCreatedLB, "Created Utho load balancer %q (%s)", lbName, lb.ID)
 
 		// Set the Utho VLB ID annotation
 		if _, ok := service.Annotations[annoUthoLoadBalancerID]; !ok {
-			if err = l.GetKubeClient(); err != nil {
-				return nil, fmt.Errorf("EnsureLoadBalancer: failed to get kubeclient to update service: %w", err)
-			}
-
-			// Get Kubernetes services
-			service, err = l.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
-			if err != nil {
-				return nil, fmt.Errorf("EnsureLoadBalancer: failed to get service with LoadBalancer ID: %w", err)
-			}
-
-			if service.Annotations == nil {
-				service.Annotations = make(map[string]string)
-			}
-			service.Annotations[annoUthoLoadBalancerID] = lb.ID
-
-			_, err = l.kubeClient.CoreV1().Services(service.Namespace).Update(ctx, service, metav1.UpdateOptions{})
-			if err != nil {
+			if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoLoadBalancerID: &lb.ID}); err != nil {
 				return nil, fmt.Errorf("EnsureLoadBalancer: failed to update service with LoadBalancer ID: %w", err)
 			}
 		}
+		if err := l.recordImmutableSettings(ctx, service); err != nil {
+			return nil, fmt.Errorf("EnsureLoadBalancer: %w", err)
+		}
 
 		getLb, err := l.client.Loadbalancers().Read(lb.ID)
 		if err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to read load balancer %s: %v", lb.ID, err)
 			return nil, fmt.Errorf("EnsureLoadBalancer: failed to get Utho LoadBalancer with ID: %w", err)
 		}
 
@@ -124,20 +133,12 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 
 	// Set the Utho VLB ID annotation
 	if _, ok := service.Annotations[annoUthoLoadBalancerID]; !ok {
-		if service.Annotations == nil {
-			service.Annotations = make(map[string]string)
-		}
-		service.Annotations[annoUthoLoadBalancerID] = lb.ID
-		if err = l.GetKubeClient(); err != nil {
-			return nil, fmt.Errorf("EnsureLoadBalancer: failed to get kubeclient to update service: %w", err)
-		}
-		_, err = l.kubeClient.CoreV1().Services(service.Namespace).Update(ctx, service, metav1.UpdateOptions{})
-		if err != nil {
+		if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoLoadBalancerID: &lb.ID}); err != nil {
 			return nil, fmt.Errorf("EnsureLoadBalancer: failed to update service with LoadBalancer ID: %w", err)
 		}
 	}
 
-	if err2 := l.UpdateLoadBalancer(ctx, clusterName, service, nodes); err2 != nil {
+	if err2 := l.updateLoadBalancer(ctx, clusterName, service, nodes); err2 != nil {
 		return nil, fmt.Errorf("EnsureLoadBalancer: %w", err2)
 	}
 
@@ -151,14 +152,26 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 
 // CreateUthoLoadBalancer sets up a LoadBalancer, its frontend, and backend configurations.
 func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1.Service, nodePoolId []string, clusterId string) (*utho.CreateLoadbalancerResponse, error) {
+	cfg, err := l.parseConfig(service)
+	if err != nil {
+		return nil, fmt.Errorf("CreateUthoLoadBalancer: %w", err)
+	}
+
+	if cfg.VPC != "" {
+		vpcId = cfg.VPC
+	}
+	dcslug, err := l.inventory.dcslug()
+	if err != nil {
+		return nil, fmt.Errorf("CreateUthoLoadBalancer: %w", err)
+	}
+
 	// Create LoadBalancer request parameters
-	enablePublicIP := getEnablePublicIP(service)
 	lbRequest := utho.CreateLoadbalancerParams{
 		Name:                lbName,
-		Dcslug:              l.zone,
+		Dcslug:              dcslug,
 		Vpc:                 vpcId,
-		Type:                "network",
-		EnablePublicip:      enablePublicIP,
+		Type:                cfg.Type,
+		EnablePublicip:      cfg.enablePublicIP(),
 		Cpumodel:            "amd",
 		KubernetesClusterid: clusterId,
 	}
@@ -167,6 +180,7 @@ func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1
 	// Create the LoadBalancer
 	lb, err := l.client.Loadbalancers().Create(lbRequest)
 	if err != nil {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to create load balancer %q: %v", lbName, err)
 		return nil, fmt.Errorf("CreateUthoLoadBalancer: failed to create LoadBalancer: %w", err)
 	}
 
@@ -174,6 +188,7 @@ func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1
 	for i := 0; i < 5; i++ {
 		readLb, err := l.client.Loadbalancers().Read(lb.ID)
 		if err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to read status of load balancer %s: %v", lb.ID, err)
 			return nil, fmt.Errorf("CreateUthoLoadBalancer: failed to read LoadBalancer status: %w", err)
 		}
 		klog.Infof("CreateUthoLoadBalancer: LoadBalancer status app check: %+v", readLb)
@@ -181,21 +196,10 @@ func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1
 		if strings.EqualFold(readLb.AppStatus, string(utho.Installed)) {
 			break
 		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonWaitingForInstall, "Waiting for load balancer %s to be installed (app status %q)", lb.ID, readLb.AppStatus)
 		time.Sleep(45 * time.Second)
 	}
 
-	// get services annotion
-	algo := getAlgorithm(service)
-
-	stickySessionEnabled := getStickySessionEnabled(service)
-
-	sslRedirect := getSSLRedirect(service)
-
-	var lBSSLID string
-	if lBSSLIDVal, ok := service.Annotations[annoUthoLBSSLID]; ok {
-		lBSSLID = lBSSLIDVal
-	}
-
 	// Iterate over each service port to configure frontend and backend
 	for _, port := range service.Spec.Ports {
 		// Ensure the protocol is TCP
@@ -203,54 +207,23 @@ func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1
 			return nil, fmt.Errorf("CreateUthoLoadBalancer: only TCP protocol is supported, got: %q", port.Protocol)
 		}
 
-		isHTTPPort := int(port.Port) == 80 || int(port.Port) == 443
-
 		// Create LoadBalancer frontend request parameters
-		feRequest := utho.CreateLoadbalancerFrontendParams{
-			LoadbalancerId: lb.ID,
-			Name:           GenerateRandomString(10),
-			Proto:          "tcp",
-			Port:           strconv.Itoa(int(port.Port)),
-			Algorithm:      algo,
-			Cookie:         stickySessionEnabled,
-		}
-
-		// Add `Redirecthttps` and `CertificateID` only for HTTP ports
-		if isHTTPPort {
-			if sslRedirect {
-				feRequest.Redirecthttps = "1"
-			}
-			if lBSSLID != "" {
-				feRequest.CertificateID = lBSSLID
-				feRequest.Proto = "https"
-			}
-		}
+		feRequest := desiredFrontend(cfg, port)
+		feRequest.Name = GenerateRandomString(10)
 
 		klog.Infof("CreateUthoLoadBalancer: LoadBalancer Frontend request: %+v", feRequest)
 
 		// Create the frontend
-		lbFe, err := l.client.Loadbalancers().CreateFrontend(feRequest)
+		lbFe, err := l.createFrontend(lb.ID, feRequest)
 		if err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to create frontend for port %d: %v", port.Port, err)
 			return nil, fmt.Errorf("CreateUthoLoadBalancer: error creating LoadBalancer frontend: %w", err)
 		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonFrontendCreated, "Created %s frontend for port %d", feRequest.Proto, port.Port)
 
 		// Configure backends for each node pool
-		for _, id := range nodePoolId {
-			feBackend := utho.CreateLoadbalancerBackendParams{
-				LoadbalancerId: lb.ID,
-				FrontendID:     lbFe.ID,
-				Type:           "kubernetes",
-				BackendPort:    strconv.Itoa(int(port.NodePort)),
-				Cloudid:        clusterId,
-				PoolName:       id,
-			}
-			klog.Infof("CreateUthoLoadBalancer: LoadBalancer Backend request: %+v", feBackend)
-
-			// Create the backend
-			_, err := l.client.Loadbalancers().CreateBackend(feBackend)
-			if err != nil {
-				return nil, fmt.Errorf("CreateUthoLoadBalancer: error creating backend: %w", err)
-			}
+		if err := l.createBackends(lb.ID, lbFe.ID, service, port, nodePoolId, clusterId); err != nil {
+			return nil, fmt.Errorf("CreateUthoLoadBalancer: %w", err)
 		}
 	}
 
@@ -260,8 +233,21 @@ func (l *loadbalancers) CreateUthoLoadBalancer(lbName, vpcId string, service *v1
 
 // UpdateLoadBalancer updates the configuration of the specified Kubernetes LoadBalancer.
 func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	unlock := l.locks.lock(service.Namespace, service.Name)
+	defer unlock()
+
+	return l.updateLoadBalancer(ctx, clusterName, service, nodes)
+}
+
+// updateLoadBalancer is UpdateLoadBalancer, for callers holding the lock of the service.
+func (l *loadbalancers) updateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
 	klog.V(3).Info("UpdateLoadBalancer: Called UpdateLoadBalancers")
 
+	cfg, err := l.parseConfig(service)
+	if err != nil {
+		return fmt.Errorf("UpdateLoadBalancer: %w", err)
+	}
+
 	// Check if the LoadBalancer already exists
 	if _, _, err := l.GetLoadBalancer(ctx, clusterName, service); err != nil {
 		return fmt.Errorf("UpdateLoadBalancer: %w", err)
@@ -274,32 +260,54 @@ func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 	}
 
 	// Ensure the Utho LoadBalancer ID annotation is set
-	if service.Annotations == nil {
-		service.Annotations = make(map[string]string)
-	}
-	if err := l.GetKubeClient(); err != nil {
-		return fmt.Errorf("UpdateLoadBalancer: failed to get kubeclient to update service: %w", err)
-	}
 	if _, ok := service.Annotations[annoUthoLoadBalancerID]; !ok {
-		service.Annotations[annoUthoLoadBalancerID] = lb.ID
-		_, err = l.kubeClient.CoreV1().Services(service.Namespace).Update(ctx, service, metav1.UpdateOptions{})
-		if err != nil {
+		if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoLoadBalancerID: &lb.ID}); err != nil {
 			return fmt.Errorf("UpdateLoadBalancer: failed to update service with LoadBalancer ID: %w", err)
 		}
 	}
+	if err := l.GetKubeClient(); err != nil {
+		return fmt.Errorf("UpdateLoadBalancer: failed to get kubeclient: %w", err)
+	}
+
+	if done, err := l.finishMigration(ctx, service); err != nil {
+		klog.Warningf("UpdateLoadBalancer: %v", err)
+	} else if !done {
+		// such as after a restart of the CCM
+		l.waitForMigration(service.Namespace, service.Name)
+	}
+	migrated, err := l.migrateIfNeeded(ctx, service, cfg, lb, nodes)
+	if err != nil {
+		return fmt.Errorf("UpdateLoadBalancer: %w", err)
+	}
+	if migrated {
+		// the replacement is fully configured already
+		return nil
+	}
 
 	// Get cluster ID
-	clusterId, err := GetLabelValue(l.kubeClient, "cluster_id")
+	clusterId, err := l.inventory.clusterID()
 	if err != nil {
 		return fmt.Errorf("UpdateLoadBalancer: failed to get cluster ID: %w", err)
 	}
 
 	// Get node pool IDs
-	nodePoolId, err := GetNodePoolsID()
+	nodePoolId, err := l.selectNodePools(service, cfg, nodes)
 	if err != nil {
-		return fmt.Errorf("UpdateLoadBalancer: failed to get node pool IDs: %w", err)
+		return fmt.Errorf("UpdateLoadBalancer: %w", err)
 	}
 
+	if err := l.syncLoadBalancer(lb, service, cfg, nodePoolId, clusterId); err != nil {
+		return fmt.Errorf("UpdateLoadBalancer: %w", err)
+	}
+
+	klog.Infof("UpdateLoadBalancer: Finished updating LoadBalancer for cluster %q, LB ID %q", clusterName, lb.ID)
+
+	return nil
+}
+
+// syncLoadBalancer creates, updates and deletes the frontends of an existing
+// load balancer and their backends, to match the service ports and node pools.
+func (l *loadbalancers) syncLoadBalancer(lb *utho.Loadbalancer, service *v1.Service, cfg *lbConfig, nodePoolId []string, clusterId string) error {
 	// Map of desired ports
 	desiredPorts := map[string]*v1.ServicePort{}
 	for _, port := range service.Spec.Ports {
@@ -307,100 +315,117 @@ func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 			portStr := strconv.Itoa(int(port.Port))
 			desiredPorts[portStr] = &port
 		} else {
-			klog.Warningf("UpdateLoadBalancer: Skipping unsupported protocol for port %d: %s", port.Port, port.Protocol)
+			klog.Warningf("syncLoadBalancer: Skipping unsupported protocol for port %d: %s", port.Port, port.Protocol)
 		}
 	}
 
-	// Get services annotation
-	algo := getAlgorithm(service)
-
-	stickySessionEnabled := getStickySessionEnabled(service)
-
-	sslRedirect := getSSLRedirect(service)
-
-	var lBSSLID string
-	if lBSSLIDVal, ok := service.Annotations[annoUthoLBSSLID]; ok {
-		lBSSLID = lBSSLIDVal
-	}
-
 	// Fetch existing frontends
-	currentFrontends := make(map[string]utho.Frontends)
-	for _, fe := range lb.Frontends {
+	frontends, err := l.listFrontends(lb.ID)
+	if err != nil {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to list frontends of load balancer %s: %v", lb.ID, err)
+		return fmt.Errorf("syncLoadBalancer: %w", err)
+	}
+	currentFrontends := make(map[string]lbFrontend)
+	for _, fe := range frontends {
 		currentFrontends[fe.Port] = fe
 	}
 
 	// Create or update frontends/backends for desired ports
 	for portStr, port := range desiredPorts {
-		if _, exists := currentFrontends[portStr]; exists {
-			klog.Infof("UpdateLoadBalancer: Frontend already exists for port %s, skipping creation.", portStr)
+		feRequest := desiredFrontend(cfg, *port)
+
+		if current, exists := currentFrontends[portStr]; exists {
+			if changes := frontendChanges(current, feRequest); len(changes) > 0 {
+				feRequest.Name = current.Name
+				klog.Infof("syncLoadBalancer: Updating load balancer frontend %s for port %s: %v", current.ID, portStr, changes)
+				if err := l.updateFrontend(lb.ID, current.ID, feRequest); err != nil {
+					l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to update frontend for port %s: %v", portStr, err)
+					return fmt.Errorf("syncLoadBalancer: error updating load balancer frontend: %w", err)
+				}
+				l.recordEvent(service, v1.EventTypeNormal, eventReasonFrontendUpdated, "Updated frontend for port %s: %s", portStr, strings.Join(changes, ", "))
+			}
+
+			if err := l.syncBackends(lb.ID, service, cfg, *port, current, nodePoolId, clusterId); err != nil {
+				return fmt.Errorf("syncLoadBalancer: %w", err)
+			}
 			continue
 		}
 
-		isHTTPPort := int(port.Port) == 80 || int(port.Port) == 443
-
 		// Create new frontend
-		feRequest := utho.CreateLoadbalancerFrontendParams{
-			LoadbalancerId: lb.ID,
-			Name:           GenerateRandomString(10),
-			Proto:          "tcp",
-			Port:           portStr,
-			Algorithm:      algo,
-			Cookie:         stickySessionEnabled,
-		}
-
-		// Add `Redirecthttps` and `CertificateID` only for HTTP ports
-		if isHTTPPort {
-			if sslRedirect {
-				feRequest.Redirecthttps = "1"
-			}
-			if lBSSLID != "" {
-				feRequest.CertificateID = lBSSLID
-				feRequest.Proto = "https"
-			}
-		}
+		feRequest.Name = GenerateRandomString(10)
 
-		klog.Infof("UpdateLoadBalancer: Creating new load balancer frontend: %+v", feRequest)
-		lbFe, err := l.client.Loadbalancers().CreateFrontend(feRequest)
+		klog.Infof("syncLoadBalancer: Creating new load balancer frontend: %+v", feRequest)
+		lbFe, err := l.createFrontend(lb.ID, feRequest)
 		if err != nil {
-			return fmt.Errorf("UpdateLoadBalancer: error creating load balancer frontend: %w", err)
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to create frontend for port %s: %v", portStr, err)
+			return fmt.Errorf("syncLoadBalancer: error creating load balancer frontend: %w", err)
 		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonFrontendCreated, "Created %s frontend for port %s", feRequest.Proto, portStr)
 
 		// Create backends for the new frontend
-		for _, id := range nodePoolId {
-			feBackend := utho.CreateLoadbalancerBackendParams{
-				LoadbalancerId: lb.ID,
-				FrontendID:     lbFe.ID,
-				Type:           "kubernetes",
-				BackendPort:    strconv.Itoa(int(port.NodePort)),
-				Cloudid:        clusterId,
-				PoolName:       id,
-			}
-			klog.Infof("UpdateLoadBalancer: Creating new load balancer backend: %+v", feBackend)
-			_, err = l.client.Loadbalancers().CreateBackend(feBackend)
-			if err != nil {
-				return fmt.Errorf("UpdateLoadBalancer: error creating load balancer backend: %w", err)
-			}
+		if err := l.createBackends(lb.ID, lbFe.ID, service, *port, nodePoolId, clusterId); err != nil {
+			return fmt.Errorf("syncLoadBalancer: %w", err)
 		}
 	}
 
 	// Remove frontends for ports no longer desired
 	for portStr, fe := range currentFrontends {
 		if _, exists := desiredPorts[portStr]; !exists {
-			klog.Infof("UpdateLoadBalancer: Deleting unused frontend for port %s", portStr)
+			klog.Infof("syncLoadBalancer: Deleting unused frontend for port %s", portStr)
 			_, err := l.client.Loadbalancers().DeleteFrontend(lb.ID, fe.ID)
 			if err != nil {
-				return fmt.Errorf("UpdateLoadBalancer: error deleting load balancer frontend: %w", err)
+				l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to delete frontend for port %s: %v", portStr, err)
+				return fmt.Errorf("syncLoadBalancer: error deleting load balancer frontend: %w", err)
 			}
+			l.recordEvent(service, v1.EventTypeNormal, eventReasonFrontendDeleted, "Deleted frontend for port %s", portStr)
 		}
 	}
 
-	klog.Infof("UpdateLoadBalancer: Finished updating LoadBalancer for cluster %q, LB ID %q", clusterName, lb.ID)
+	return nil
+}
+
+// createBackends adds a backend for each node pool, or each instance with
+// instance backends, to a frontend, forwarding to the node port of the service port.
+func (l *loadbalancers) createBackends(lbID, frontendID string, service *v1.Service, port v1.ServicePort, nodePoolId []string, clusterId string) error {
+	cfg, err := parseLBConfig(service)
+	if err != nil {
+		return fmt.Errorf("createBackends: %w", err)
+	}
+	target := "node pool"
+	if cfg.instanceBackends() {
+		target = "instance"
+	}
+
+	for _, id := range nodePoolId {
+		feBackend := backendRequest{
+			FrontendID:  frontendID,
+			Type:        "kubernetes",
+			BackendPort: strconv.Itoa(int(port.NodePort)),
+			Cloudid:     clusterId,
+			PoolName:    id,
+			Proto:       cfg.backendProto(port),
+		}
+		if cfg.instanceBackends() {
+			// every instance is a backend of its own
+			feBackend.Type, feBackend.Cloudid, feBackend.PoolName = "cloud", id, ""
+		}
+		klog.Infof("createBackends: LoadBalancer Backend request: %+v", feBackend)
 
+		if _, err := l.createBackend(lbID, feBackend); err != nil {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to create backend for %s %s on port %d: %v", target, id, port.Port, err)
+			return fmt.Errorf("createBackends: error creating backend: %w", err)
+		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonBackendCreated, "Created backend for %s %s on node port %d", target, id, port.NodePort)
+	}
 	return nil
 }
 
 // EnsureLoadBalancerDeleted ensures that a LoadBalancer associated with a specific service is deleted.
 func (l *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	unlock := l.locks.lock(service.Namespace, service.Name)
+	defer unlock()
+	stopMigration(service.Namespace, service.Name)
+
 	_, exists, err := l.GetLoadBalancer(ctx, clusterName, service)
 	if err != nil {
 		return fmt.Errorf("EnsureLoadBalancerDeleted: %w", err)
@@ -417,9 +442,19 @@ func (l *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterNa
 
 	_, err = l.client.Loadbalancers().Delete(lb.ID)
 	if err != nil {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to delete load balancer %s: %v", lb.ID, err)
 		return fmt.Errorf("EnsureLoadBalancerDeleted: failed to delete LoadBalancer: %w", err)
 	}
 	klog.Infof("EnsureLoadBalancerDeleted: Finished deleting LoadBalancer for cluster %q, LB ID %q", clusterName, lb.ID)
+	l.recordEvent(service, v1.EventTypeNormal, eventReasonDeletedLB, "Deleted Utho load balancer %s", lb.ID)
+
+	// A load balancer replaced by a migration may not have been deleted yet
+	if oldID := service.Annotations[annoUthoPendingDelete]; oldID != "" {
+		if _, err := l.client.Loadbalancers().Delete(oldID); err != nil && !isNotFound(err) {
+			return fmt.Errorf("EnsureLoadBalancerDeleted: failed to delete replaced LoadBalancer %s: %w", oldID, err)
+		}
+		l.recordEvent(service, v1.EventTypeNormal, eventReasonDeletedLB, "Deleted replaced Utho load balancer %s", oldID)
+	}
 
 	return nil
 }
@@ -503,16 +538,27 @@ func (l *loadbalancers) getUthoLB(ctx context.Context, service *v1.Service) (*ut
 	// If the LoadBalancer ID is available in annotations, use it to fetch the LoadBalancer
 	if id, ok := service.Annotations[annoUthoLoadBalancerID]; ok {
 		lb, err := l.client.Loadbalancers().Read(id)
-		if err != nil {
+		if err == nil {
+			return lb, nil
+		}
+		if !isNotFound(err) {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to read load balancer %s: %v", id, err)
 			return nil, err
 		}
-		return lb, nil
+
+		// The load balancer was deleted outside of the CCM, forget its ID and
+		// fall back to the name lookup, which recreates it if nothing is found.
+		klog.Warningf("getUthoLB: load balancer %s of service %s/%s no longer exists", id, service.Namespace, service.Name)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonStaleLBID, "Load balancer %s no longer exists, clearing %s", id, annoUthoLoadBalancerID)
+		if err := l.removeLBIDAnnotation(ctx, service); err != nil {
+			return nil, fmt.Errorf("getUthoLB: %w", err)
+		}
 	}
 
 	if err := l.GetKubeClient(); err != nil {
 		return nil, fmt.Errorf("getUthoLB: failed to get kubeclient: %w", err)
 	}
-	clusterId, err := GetLabelValue(l.kubeClient, "cluster_id")
+	clusterId, err := l.inventory.clusterID()
 	if err != nil {
 		return nil, fmt.Errorf("getUthoLB: failed to get cluster ID: %w", err)
 	}
@@ -527,72 +573,110 @@ func (l *loadbalancers) getUthoLB(ctx context.Context, service *v1.Service) (*ut
 	// If not found, attempt to retrieve by explicitly specified LoadBalancer name
 	lbName := l.GetLoadBalancerName(ctx, "", service)
 	lb, err = l.lbByName(lbName, clusterId)
+	if err == errLbNotFound {
+		// a load balancer replaced by migrateIfNeeded has a name of its own
+		if settings := service.Annotations[annoUthoImmutableSettings]; settings != "" {
+			lb, err = l.lbByName(migratedLBName(lbName, settings), clusterId)
+		}
+	}
 	if err != nil {
+		if err != errLbNotFound {
+			l.recordEvent(service, v1.EventTypeWarning, eventReasonAPIError, "Failed to list load balancers: %v", err)
+		}
 		return nil, err
 	}
 	return lb, nil
 }
 
-// getDefaultLBName generates a default LoadBalancer name for a service.
-func getDefaultLBName(service *v1.Service) string {
-	return cloudprovider.DefaultLoadBalancerName(service)
+// removeLBIDAnnotation removes the load balancer ID annotation from a service,
+// both in the API and on the given object.
+func (l *loadbalancers) removeLBIDAnnotation(ctx context.Context, service *v1.Service) error {
+	if err := l.patchServiceAnnotations(ctx, service, map[string]*string{annoUthoLoadBalancerID: nil}); err != nil {
+		return fmt.Errorf("removeLBIDAnnotation: %w", err)
+	}
+	return nil
 }
 
-// getSSLRedirect returns if traffic should be redirected to https
-// default to false if not specified
-func getSSLRedirect(service *v1.Service) bool {
-	redirect, ok := service.Annotations[annoUthoRedirectHTTPToHTTPS]
-	if !ok {
-		return false
+// patchServiceAnnotations sets the given annotations on a service, or removes
+// the ones with a nil value, both in the API and on the given object. The
+// Services built for Gateways are only changed in memory.
+func (l *loadbalancers) patchServiceAnnotations(ctx context.Context, service *v1.Service, annotations map[string]*string) error {
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
 	}
-
-	redirectBool, err := strconv.ParseBool(redirect)
-	if err != nil {
-		return false
+	for key, value := range annotations {
+		if value == nil {
+			delete(service.Annotations, key)
+		} else {
+			service.Annotations[key] = *value
+		}
 	}
 
-	return redirectBool
-}
-
-// getAlgorithm returns the algorithm to be used for load balancer service
-// defaults to round_robin if no algorithm is provided.
-func getAlgorithm(service *v1.Service) string {
-	algo := service.Annotations[annoUthoAlgorithm]
-	if algo == "leastconn" {
-		return "leastconn"
+	if _, ok := service.Annotations[annoGatewayService]; ok {
+		return nil
 	}
 
-	return "roundrobin"
+	if err := l.GetKubeClient(); err != nil {
+		return fmt.Errorf("patchServiceAnnotations: failed to get kubeclient: %w", err)
+	}
+	// Only the given annotations are sent, without a resourceVersion, so
+	// concurrent changes to the rest of the service are neither overwritten nor
+	// cause conflicts.
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return fmt.Errorf("patchServiceAnnotations: %w", err)
+	}
+	if _, err := l.kubeClient.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("patchServiceAnnotations: %w", err)
+	}
+	return nil
 }
 
-// getStickySessionEnabled returns whether or not sticky sessions should be enabled
-// default is off
-func getStickySessionEnabled(service *v1.Service) string {
-	enabled, ok := service.Annotations[annoUthoStickySessionEnabled]
-	if !ok {
-		return "0"
+// isNotFound returns whether an error of the Utho API means the requested
+// resource does not exist.
+func isNotFound(err error) bool {
+	var errResp *utho.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.StatusCode == http.StatusNotFound
 	}
+	// Read returns "NotFound" for an empty result; the messages of other calls
+	// may mention a missing resource other than the one requested
+	return err.Error() == errSDKNotFound
+}
 
-	if enabled == "0" {
-		return "0"
-	} else if enabled == "1" {
-		return "1"
-	}
+// errSDKNotFound is the message of the error the SDK returns when a Read finds nothing.
+const errSDKNotFound = "NotFound"
 
-	return "0"
+// getDefaultLBName generates a default LoadBalancer name for a service.
+func getDefaultLBName(service *v1.Service) string {
+	return cloudprovider.DefaultLoadBalancerName(service)
 }
 
-// getEnablePublicIP returns the enablepublicip value based on network type annotation
-// If network type is "private", returns "false", otherwise returns "true" (default)
-func getEnablePublicIP(service *v1.Service) string {
-	networkType, ok := service.Annotations[annoUthoNetworkType]
-	if !ok {
-		return "true"
+// parseConfig parses the Utho annotations of a service. Invalid values and
+// conflicting settings fail the reconciliation, as the admission webhook denies
+// them, while unknown utho-loadbalancer-* keys are reported as warnings.
+func (l *loadbalancers) parseConfig(service *v1.Service) (*lbConfig, error) {
+	for _, key := range unknownAnnotations(service) {
+		klog.Warningf("parseConfig: ignoring unknown annotation %q on service %s/%s", key, service.Namespace, service.Name)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonUnknownAnnotation, "Ignoring unknown annotation %q", key)
 	}
 
-	if strings.EqualFold(networkType, "private") {
-		return "false"
+	cfg, err := parseLBConfig(service)
+	if err != nil {
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonInvalidAnnotation, "%v", err)
+		return nil, err
 	}
 
-	return "true"
+	conflicts, warnings := cfg.conflicts(service)
+	for _, warning := range warnings {
+		klog.V(2).Infof("parseConfig: service %s/%s: %s", service.Namespace, service.Name, warning)
+	}
+	if len(conflicts) > 0 {
+		err := utilerrors.NewAggregate(conflicts)
+		l.recordEvent(service, v1.EventTypeWarning, eventReasonAnnotationConflict, "%v", err)
+		return nil, fmt.Errorf("parseConfig: service %s/%s: %w", service.Namespace, service.Name, err)
+	}
+	return cfg, nil
 }
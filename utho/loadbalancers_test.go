@@ -0,0 +1,95 @@
+package utho
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPatchServiceAnnotations(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web",
+			Annotations: map[string]string{
+				annoUthoLoadBalancerID: "lb-1",
+				annoUthoPendingDelete:  "lb-0",
+			},
+		},
+	})
+	l := &loadbalancers{kubeClient: kubeClient, locks: &serviceLocks{}}
+
+	// the copy the CCM works on
+	service, err := kubeClient.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another writer changes the service between the read and the patch
+	latest := service.DeepCopy()
+	latest.Annotations["example.com/owner"] = "team-a"
+	latest.Labels = map[string]string{"app": "web"}
+	latest.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80}}
+	if _, err := kubeClient.CoreV1().Services("default").Update(ctx, latest, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := "lb-2"
+	if err := l.patchServiceAnnotations(ctx, service, map[string]*string{
+		annoUthoLoadBalancerID: &id,
+		annoUthoPendingDelete:  nil,
+	}); err != nil {
+		t.Fatalf("patchServiceAnnotations() error = %v", err)
+	}
+
+	got, err := kubeClient.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Annotations[annoUthoLoadBalancerID] != id {
+		t.Errorf("annotation %s = %q, want %q", annoUthoLoadBalancerID, got.Annotations[annoUthoLoadBalancerID], id)
+	}
+	if _, ok := got.Annotations[annoUthoPendingDelete]; ok {
+		t.Errorf("annotation %s was not removed", annoUthoPendingDelete)
+	}
+	if got.Annotations["example.com/owner"] != "team-a" || got.Labels["app"] != "web" || len(got.Spec.Ports) != 1 {
+		t.Errorf("concurrent changes were overwritten: annotations %v, labels %v, ports %v", got.Annotations, got.Labels, got.Spec.Ports)
+	}
+
+	// the given object is updated too
+	if service.Annotations[annoUthoLoadBalancerID] != id {
+		t.Errorf("object annotation %s = %q, want %q", annoUthoLoadBalancerID, service.Annotations[annoUthoLoadBalancerID], id)
+	}
+	if _, ok := service.Annotations[annoUthoPendingDelete]; ok {
+		t.Errorf("object annotation %s was not removed", annoUthoPendingDelete)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "API 404", err: &utho.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}, want: true},
+		{name: "API 500", err: &utho.ErrorResponse{Response: &http.Response{StatusCode: http.StatusInternalServerError}}},
+		{name: "empty read", err: errors.New("NotFound"), want: true},
+		{name: "missing frontend", err: errors.New("Frontend not found")},
+		{name: "missing certificate", err: errors.New("certificate not found")},
+		{name: "other error", err: errors.New("timeout")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFound(tt.err); got != tt.want {
+				t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package utho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// routeDescriptionPrefix starts the description of the VPC routes created by
+// the CCM, followed by the cluster name and the node name. Routes with any
+// other description are left alone.
+const routeDescriptionPrefix = "k8s-route"
+
+// routes implements cloudprovider.Routes on the route table of the cluster VPC,
+// routing the pod CIDR of each node to the private IP of its instance.
+type routes struct {
+	client    utho.Client
+	inventory *inventory
+}
+
+var _ cloudprovider.Routes = &routes{}
+
+// vpcRoute is a route of a VPC route table. The SDK does not expose them, so
+// they are managed with raw requests.
+type vpcRoute struct {
+	ID          string `json:"id,omitempty"`
+	Destination string `json:"destination"`
+	Target      string `json:"target"`
+	Description string `json:"description"`
+}
+
+// vpcRouteResponse is the response of the route table calls. Routes is nil if
+// the response has no routes key, so that a listing in an unexpected shape is
+// not mistaken for an empty route table.
+type vpcRouteResponse struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Routes  *[]vpcRoute `json:"routes"`
+}
+
+func newRoutes(client utho.Client, inv *inventory) cloudprovider.Routes {
+	return &routes{client: client, inventory: inv}
+}
+
+// ListRoutes lists the routes of the cluster in the VPC route table. Routes
+// whose node is gone, whose instance is no longer found, or whose target is no
+// longer the private IP CreateRoute would route to are blackholes, which the
+// route controller deletes. Other errors of the Utho API fail the listing, so
+// that routes are not deleted for them.
+func (r *routes) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	vpcRoutes, err := r.listVPCRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("ListRoutes: %w", err)
+	}
+	nodes, err := listNodes()
+	if err != nil {
+		return nil, fmt.Errorf("ListRoutes: %w", err)
+	}
+	byName := make(map[string]*v1.Node, len(nodes))
+	for idx := range nodes {
+		byName[nodes[idx].Name] = &nodes[idx]
+	}
+
+	// targets holds the private IP of each node a route targets, "" if it has none
+	targets := make(map[string]string)
+	prefix := routeDescription(clusterName, "")
+	var result []*cloudprovider.Route
+	for _, route := range vpcRoutes {
+		nodeName, ok := strings.CutPrefix(route.Description, prefix)
+		if !ok {
+			continue
+		}
+		target, known := targets[nodeName]
+		if !known {
+			if node, exists := byName[nodeName]; exists {
+				target, err = r.nodeTarget(node)
+				if err != nil && !errors.Is(err, cloudprovider.InstanceNotFound) {
+					return nil, fmt.Errorf("ListRoutes: %w", err)
+				}
+				if err != nil {
+					klog.Warningf("ListRoutes: route %s of %s: %v", route.ID, route.Destination, err)
+				}
+			}
+			targets[nodeName] = target
+		}
+		result = append(result, &cloudprovider.Route{
+			Name:            route.ID,
+			TargetNode:      types.NodeName(nodeName),
+			DestinationCIDR: route.Destination,
+			Blackhole:       target == "" || target != route.Target,
+		})
+	}
+	return result, nil
+}
+
+// CreateRoute routes the pod CIDR of a node to the private IP of its instance,
+// unless the route table already has that route.
+func (r *routes) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	ip, _, err := net.ParseCIDR(route.DestinationCIDR)
+	if err != nil {
+		return fmt.Errorf("CreateRoute: invalid destination %q: %w", route.DestinationCIDR, err)
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("CreateRoute: VPC routes only support IPv4 destinations, not %s", route.DestinationCIDR)
+	}
+
+	target, err := r.nodePrivateIP(string(route.TargetNode))
+	if err != nil {
+		return fmt.Errorf("CreateRoute: %w", err)
+	}
+
+	body := vpcRoute{
+		Destination: route.DestinationCIDR,
+		Target:      target,
+		Description: routeDescription(clusterName, string(route.TargetNode)),
+	}
+	vpcRoutes, err := r.listVPCRoutes()
+	if err != nil {
+		return fmt.Errorf("CreateRoute: %w", err)
+	}
+	for _, existing := range vpcRoutes {
+		if existing.Destination == body.Destination && existing.Target == body.Target && existing.Description == body.Description {
+			klog.Infof("CreateRoute: %s is already routed to node %s (%s)", route.DestinationCIDR, route.TargetNode, target)
+			return nil
+		}
+	}
+	if _, err := r.vpcRequest("POST", "route", &body); err != nil {
+		return fmt.Errorf("CreateRoute: failed to route %s to node %s: %w", route.DestinationCIDR, route.TargetNode, err)
+	}
+	klog.Infof("CreateRoute: routed %s to node %s (%s)", route.DestinationCIDR, route.TargetNode, target)
+	return nil
+}
+
+// DeleteRoute deletes a route returned by ListRoutes.
+func (r *routes) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	if _, err := r.vpcRequest("DELETE", "route/"+route.Name, nil); err != nil && !isNotFound(err) {
+		return fmt.Errorf("DeleteRoute: failed to delete route %s of %s: %w", route.Name, route.DestinationCIDR, err)
+	}
+	klog.Infof("DeleteRoute: deleted route of %s to node %s", route.DestinationCIDR, route.TargetNode)
+	return nil
+}
+
+func (r *routes) listVPCRoutes() ([]vpcRoute, error) {
+	res, err := r.vpcRequest("GET", "route", nil)
+	if err != nil {
+		return nil, fmt.Errorf("listVPCRoutes: %w", err)
+	}
+	if res.Routes == nil {
+		return nil, fmt.Errorf("listVPCRoutes: the response has no routes")
+	}
+	return *res.Routes, nil
+}
+
+// vpcRequest sends a request for the route table of the cluster VPC.
+func (r *routes) vpcRequest(method, path string, body *vpcRoute) (*vpcRouteResponse, error) {
+	vpcID, err := r.inventory.vpcID()
+	if err != nil {
+		return nil, fmt.Errorf("vpcRequest: %w", err)
+	}
+
+	var req *http.Request
+	if body != nil {
+		req, err = r.client.NewRequest(method, "vpc/"+vpcID+"/"+path, body)
+	} else {
+		req, err = r.client.NewRequest(method, "vpc/"+vpcID+"/"+path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vpcRequest: %w", err)
+	}
+
+	var res vpcRouteResponse
+	if _, err := r.client.Do(req, &res); err != nil {
+		return nil, fmt.Errorf("vpcRequest: %w", err)
+	}
+	if res.Status != "success" && res.Status != "" {
+		return nil, fmt.Errorf("vpcRequest: %s", res.Message)
+	}
+	return &res, nil
+}
+
+// nodePrivateIP returns the private IP of the instance of a node.
+func (r *routes) nodePrivateIP(nodeName string) (string, error) {
+	nodes, err := listNodes()
+	if err != nil {
+		return "", fmt.Errorf("nodePrivateIP: %w", err)
+	}
+	for idx := range nodes {
+		if nodes[idx].Name != nodeName {
+			continue
+		}
+		target, err := r.nodeTarget(&nodes[idx])
+		if err != nil {
+			return "", fmt.Errorf("nodePrivateIP: %w", err)
+		}
+		return target, nil
+	}
+	return "", fmt.Errorf("nodePrivateIP: node %s not found", nodeName)
+}
+
+// nodeTarget returns the private IP of the instance of a node, the target of
+// its route. A node whose instance is unknown, or has no private IP, is
+// reported as cloudprovider.InstanceNotFound.
+func (r *routes) nodeTarget(node *v1.Node) (string, error) {
+	id, err := getInstanceIDFromProviderID(node)
+	if err != nil {
+		return "", fmt.Errorf("nodeTarget: node %s: %w: %w", node.Name, cloudprovider.InstanceNotFound, err)
+	}
+
+	var worker *utho.WorkerNode
+	if unmanagedMode() {
+		instance, err := r.inventory.cloudInstance(id, "")
+		if err != nil {
+			return "", fmt.Errorf("nodeTarget: instance %s: %w", id, err)
+		}
+		worker = workerFromCloudInstance(instance)
+	} else if worker, _, _, err = r.inventory.worker(id); err != nil {
+		return "", fmt.Errorf("nodeTarget: instance %s: %w", id, err)
+	}
+	if worker.PrivateNetwork.Ip == "" {
+		return "", fmt.Errorf("nodeTarget: instance %s of node %s has no private IP: %w", id, node.Name, cloudprovider.InstanceNotFound)
+	}
+	return worker.PrivateNetwork.Ip, nil
+}
+
+// routeDescription is the description of the route of a node, a prefix of the
+// descriptions of all the routes of the cluster if nodeName is empty.
+func routeDescription(clusterName, nodeName string) string {
+	return routeDescriptionPrefix + "/" + clusterName + "/" + nodeName
+}
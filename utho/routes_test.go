@@ -0,0 +1,203 @@
+package utho
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uthoplatforms/utho-go/utho"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+// routeCalls records the requests made to the fake route table API.
+type routeCalls struct {
+	requests []string
+	created  []vpcRoute
+}
+
+// newTestRoutes returns routes backed by a fake Utho API answering the route
+// listing with listing, a cluster whose workers have the given private IPs,
+// and the given nodes.
+func newTestRoutes(t *testing.T, listing string, workers map[string]string, nodes ...*v1.Node) (*routes, *routeCalls) {
+	t.Helper()
+
+	calls := &routeCalls{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.requests = append(calls.requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			_, _ = w.Write([]byte(listing))
+		case "POST":
+			var route vpcRoute
+			if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+				t.Errorf("decoding route: %v", err)
+			}
+			calls.created = append(calls.created, route)
+			_, _ = w.Write([]byte(`{"status":"success"}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	apiURL := Options.APIURL
+	Options.APIURL = server.URL + "/"
+	t.Cleanup(func() { Options.APIURL = apiURL })
+
+	client, err := newSharedClient("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := utho.NodepoolDetails{Id: "pool-1"}
+	for id, ip := range workers {
+		pool.Workers = append(pool.Workers, utho.WorkerNode{ID: id, PrivateNetwork: utho.PrivateNetwork{Ip: ip}})
+	}
+	inv := newInventory(client, time.Hour)
+	inv.id = &clusterIdentity{ClusterID: "cluster-1", VPC: "vpc-1", Dcslug: "inmumbaizone2"}
+	inv.cluster = &utho.KubernetesCluster{Nodepools: map[string]utho.NodepoolDetails{"pool-1": pool}}
+	inv.fetched = time.Now()
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		if err := indexer.Add(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodeCache.Lock()
+	lister := nodeCache.lister
+	nodeCache.lister = corelisters.NewNodeLister(indexer)
+	nodeCache.Unlock()
+	t.Cleanup(func() {
+		nodeCache.Lock()
+		nodeCache.lister = lister
+		nodeCache.Unlock()
+	})
+
+	return &routes{client: client, inventory: inv}, calls
+}
+
+func testNode(name, instanceID string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ProviderID: "utho://" + instanceID},
+	}
+}
+
+func TestListRoutesBlackholes(t *testing.T) {
+	listing := `{"status":"success","routes":[
+		{"id":"r-ok","destination":"10.244.0.0/24","target":"10.0.0.1","description":"k8s-route/kubernetes/node-a"},
+		{"id":"r-moved","destination":"10.244.1.0/24","target":"10.0.0.9","description":"k8s-route/kubernetes/node-b"},
+		{"id":"r-gone","destination":"10.244.2.0/24","target":"10.0.0.3","description":"k8s-route/kubernetes/node-gone"},
+		{"id":"r-no-ip","destination":"10.244.3.0/24","target":"10.0.0.4","description":"k8s-route/kubernetes/node-c"},
+		{"id":"r-no-instance","destination":"10.244.4.0/24","target":"10.0.0.5","description":"k8s-route/kubernetes/node-d"},
+		{"id":"r-other-cluster","destination":"10.245.0.0/24","target":"10.0.0.1","description":"k8s-route/other/node-a"},
+		{"id":"r-manual","destination":"192.168.0.0/24","target":"10.0.0.1","description":"vpn"}
+	]}`
+	workers := map[string]string{"inst-a": "10.0.0.1", "inst-b": "10.0.0.2", "inst-c": ""}
+	r, _ := newTestRoutes(t, listing, workers,
+		testNode("node-a", "inst-a"), testNode("node-b", "inst-b"), testNode("node-c", "inst-c"), testNode("node-d", "inst-d"))
+
+	got, err := r.ListRoutes(context.Background(), "kubernetes")
+	if err != nil {
+		t.Fatalf("ListRoutes() error = %v", err)
+	}
+	blackholes := make(map[string]bool)
+	for _, route := range got {
+		blackholes[route.Name] = route.Blackhole
+	}
+
+	tests := []struct {
+		name      string
+		route     string
+		blackhole bool
+	}{
+		{name: "target is the node private IP", route: "r-ok"},
+		{name: "target changed", route: "r-moved", blackhole: true},
+		{name: "node gone", route: "r-gone", blackhole: true},
+		{name: "no private IP", route: "r-no-ip", blackhole: true},
+		{name: "instance not found", route: "r-no-instance", blackhole: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blackhole, ok := blackholes[tt.route]
+			if !ok {
+				t.Fatalf("route %s not listed", tt.route)
+			}
+			if blackhole != tt.blackhole {
+				t.Errorf("route %s Blackhole = %v, want %v", tt.route, blackhole, tt.blackhole)
+			}
+		})
+	}
+	if len(got) != len(tests) {
+		t.Errorf("ListRoutes() returned %d routes, want the %d of the cluster", len(got), len(tests))
+	}
+}
+
+func TestListRoutesUnexpectedResponse(t *testing.T) {
+	r, _ := newTestRoutes(t, `{"status":"success","data":[]}`, nil, testNode("node-a", "inst-a"))
+
+	if _, err := r.ListRoutes(context.Background(), "kubernetes"); err == nil {
+		t.Error("ListRoutes() error = nil for a response without routes")
+	}
+}
+
+func TestCreateRoute(t *testing.T) {
+	existing := `{"status":"success","routes":[
+		{"id":"r-ok","destination":"10.244.0.0/24","target":"10.0.0.1","description":"k8s-route/kubernetes/node-a"}
+	]}`
+	tests := []struct {
+		name        string
+		listing     string
+		destination string
+		wantErr     bool
+		wantCreated bool
+	}{
+		{name: "new route", listing: `{"status":"success","routes":[]}`, destination: "10.244.0.0/24", wantCreated: true},
+		{name: "existing route", listing: existing, destination: "10.244.0.0/24"},
+		{name: "IPv6 destination", listing: existing, destination: "fd00:10:244::/64", wantErr: true},
+		{name: "invalid destination", listing: existing, destination: "10.244.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, calls := newTestRoutes(t, tt.listing, map[string]string{"inst-a": "10.0.0.1"}, testNode("node-a", "inst-a"))
+
+			err := r.CreateRoute(context.Background(), "kubernetes", "", &cloudprovider.Route{
+				TargetNode:      types.NodeName("node-a"),
+				DestinationCIDR: tt.destination,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateRoute() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && len(calls.requests) > 0 {
+				t.Errorf("CreateRoute() sent %q for a rejected destination", calls.requests)
+			}
+			if !tt.wantCreated {
+				if len(calls.created) > 0 {
+					t.Errorf("CreateRoute() created %+v, want no route", calls.created)
+				}
+				return
+			}
+
+			want := vpcRoute{Destination: tt.destination, Target: "10.0.0.1", Description: "k8s-route/kubernetes/node-a"}
+			if len(calls.created) != 1 || calls.created[0] != want {
+				t.Errorf("CreateRoute() created %+v, want %+v", calls.created, want)
+			}
+			for _, req := range calls.requests {
+				if !strings.HasPrefix(req, "GET /vpc/vpc-1/") && req != "POST /vpc/vpc-1/route" {
+					t.Errorf("CreateRoute() sent %s", req)
+				}
+			}
+		})
+	}
+}
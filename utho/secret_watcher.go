@@ -0,0 +1,92 @@
+package utho
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// apiKeySecretKey is the key of the API key in the watched Secret.
+	apiKeySecretKey = "api-key"
+
+	secretWatcherResync = 10 * time.Minute
+)
+
+// secretWatcher switches the shared Utho client to the API key of the
+// --utho-api-key-secret Secret whenever it changes, so that the key can be
+// rotated without restarting the CCM.
+type secretWatcher struct {
+	client   *sharedClient
+	recorder record.EventRecorder
+}
+
+// startSecretWatcher watches the API key Secret in the background until stop
+// is closed. It does nothing if --utho-api-key-secret is empty.
+func startSecretWatcher(client *sharedClient, kubeClient kubernetes.Interface, recorder record.EventRecorder, stop <-chan struct{}) error {
+	if Options.APIKeySecret == "" {
+		return nil
+	}
+	namespace, name, found := strings.Cut(Options.APIKeySecret, "/")
+	if !found || namespace == "" || name == "" {
+		return fmt.Errorf("startSecretWatcher: invalid secret %q (expected namespace/name)", Options.APIKeySecret)
+	}
+
+	w := &secretWatcher{client: client, recorder: recorder}
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, secretWatcherResync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+
+	informer := factory.Core().V1().Secrets().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { w.sync(obj) },
+		UpdateFunc: func(_, obj interface{}) { w.sync(obj) },
+	}); err != nil {
+		return fmt.Errorf("startSecretWatcher: %w", err)
+	}
+
+	factory.Start(stop)
+	klog.Infof("startSecretWatcher: watching the Utho API key in secret %s/%s", namespace, name)
+	return nil
+}
+
+// sync switches to the API key of the Secret if it changed and the Utho API
+// accepts it. A rejected key is reported as an Event on the Secret, and the
+// previous key stays in use.
+func (w *secretWatcher) sync(obj interface{}) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return
+	}
+
+	token := strings.TrimSpace(string(secret.Data[apiKeySecretKey]))
+	if _, current := w.client.current(); token == "" || token == current {
+		return
+	}
+
+	client, err := newUthoClient(token)
+	if err == nil {
+		// any authenticated call would do, the account is the smallest one
+		_, err = client.Account().Read()
+	}
+	if err != nil {
+		klog.Errorf("secretWatcher: rejected the API key of secret %s/%s, keeping the previous one: %v", secret.Namespace, secret.Name, err)
+		w.recorder.Eventf(secret, v1.EventTypeWarning, eventReasonAPIKeyRejected, "The Utho API rejected the new API key, the previous one stays in use: %v", err)
+		return
+	}
+
+	w.client.swap(client, token)
+	klog.Infof("secretWatcher: switched to the API key of secret %s/%s", secret.Namespace, secret.Name)
+	w.recorder.Eventf(secret, v1.EventTypeNormal, eventReasonAPIKeyRotated, "Switched to the new Utho API key")
+}
@@ -0,0 +1,160 @@
+package utho
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// webhookServicePath is the path the Service validation webhook is served on.
+	webhookServicePath = "/validate-service"
+
+	// defaultCCMServiceAccount is the user the CCM talks to the API server as
+	// when deployed with docs/releases/latest.yml.
+	defaultCCMServiceAccount = "system:serviceaccount:kube-system:utho-ccm"
+)
+
+// StartWebhookServer starts the validating admission webhook for Services in the
+// background if --utho-webhook-bind-address is set. The server is shut down once
+// stop is closed.
+func StartWebhookServer(stop <-chan struct{}) error {
+	if Options.WebhookBindAddress == "" {
+		return nil
+	}
+	if Options.WebhookCertFile == "" || Options.WebhookKeyFile == "" {
+		return fmt.Errorf("StartWebhookServer: --utho-webhook-cert-file and --utho-webhook-key-file are required")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookServicePath, serveServiceValidation)
+
+	server := &http.Server{
+		Addr:              Options.WebhookBindAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		klog.Infof("StartWebhookServer: serving Service validation on %s%s", Options.WebhookBindAddress, webhookServicePath)
+		if err := server.ListenAndServeTLS(Options.WebhookCertFile, Options.WebhookKeyFile); err != nil && err != http.ErrServerClosed {
+			klog.Fatalf("StartWebhookServer: %v", err)
+		}
+	}()
+
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	return nil
+}
+
+// serveServiceValidation decodes an AdmissionReview and answers it with the
+// result of validateServiceAdmission.
+func serveServiceValidation(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "failed to decode AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	response := validateServiceAdmission(review.Request)
+	response.UID = review.Request.UID
+
+	out, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode AdmissionReview: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// validateServiceAdmission rejects LoadBalancer Services with malformed or
+// conflicting Utho annotations, and changes to the CCM-managed annotations made
+// by anyone other than the CCM itself.
+func validateServiceAdmission(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Kind.Kind != "Service" || req.Operation == admissionv1.Delete {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	service := &v1.Service{}
+	if err := json.Unmarshal(req.Object.Raw, service); err != nil {
+		return denyAdmission(fmt.Errorf("failed to decode service: %w", err))
+	}
+
+	var errs []error
+	var warnings []string
+
+	if req.UserInfo.Username != Options.WebhookCCMServiceAccount {
+		oldService := &v1.Service{}
+		if req.Operation == admissionv1.Update {
+			if err := json.Unmarshal(req.OldObject.Raw, oldService); err != nil {
+				return denyAdmission(fmt.Errorf("failed to decode old service: %w", err))
+			}
+		}
+		for _, key := range ccmManagedAnnotations {
+			if service.Annotations[key] != oldService.Annotations[key] {
+				errs = append(errs, fmt.Errorf("%s is managed by the cloud controller manager and cannot be changed by %q",
+					key, req.UserInfo.Username))
+			}
+		}
+	}
+
+	if _, handled := serviceLBClass(service); handled && service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		cfg, err := parseLBConfig(service)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			conflicts, conflictWarnings := cfg.conflicts(service)
+			errs = append(errs, conflicts...)
+			warnings = append(warnings, conflictWarnings...)
+		}
+
+		for _, key := range unknownAnnotations(service) {
+			warnings = append(warnings, fmt.Sprintf("unknown annotation %q is ignored", key))
+		}
+	}
+
+	if len(errs) > 0 {
+		resp := denyAdmission(utilerrors.NewAggregate(errs))
+		resp.Warnings = warnings
+		return resp
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+}
+
+// denyAdmission returns a response rejecting the request with err.
+func denyAdmission(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}